@@ -4,35 +4,94 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
 
+	"github.com/libp2p/go-libp2p-core/peer"
 	mafmt "github.com/multiformats/go-multiaddr-fmt"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 )
 
+// P_TLS is the multiaddr code of /tls, not yet known to this multiaddr
+// version.
+const P_TLS = 0x01c0
+
+// P_SSH is the multiaddr code of /ssh - SSH directly over TCP. From the
+// private use range, until registered.
+const P_SSH = 0x300100
+
+// P_WSSH is the multiaddr code of /wssh - SSH over WebSocket. /ws is also
+// accepted, for compatibility with the ws transport addresses.
+const P_WSSH = 0x300101
+
+// P_HTTP_PATH is the multiaddr code of /http-path, with the URL path escaped
+// - /http-path/p2p%2Fws is requested as /p2p/ws.
+const P_HTTP_PATH = 0x01e1
+
+var wsBase = mafmt.Or(
+	mafmt.Base(P_WSSH),
+	mafmt.Base(ma.P_WS),
+	mafmt.Base(ma.P_WSS),
+	mafmt.And(mafmt.Base(P_TLS), mafmt.Or(mafmt.Base(ma.P_WS), mafmt.Base(P_WSSH))),
+)
+
+// wsProtocols are the accepted WebSocket suffixes - /wssh, /ws, /wss and
+// /tls/ws or /tls/wssh, optionally followed by /http-path.
+var wsProtocols = mafmt.Or(
+	// Longest first - Or uses the first partial match.
+	mafmt.And(wsBase, mafmt.Base(P_HTTP_PATH)),
+	wsBase,
+)
+
 // WsFmt is multiaddr formatter for WsProtocol
-var WsFmt = mafmt.And(mafmt.TCP, mafmt.Base(ma.P_WS))
+var WsFmt = mafmt.And(mafmt.TCP, wsProtocols)
 
 // WsCodec is the multiaddr-net codec definition for the websocket transport
 var WsCodec = &manet.NetCodec{
-	NetAddrNetworks:  []string{"ws"},
-	ProtocolName:     "ws",
+	NetAddrNetworks:  []string{"wssh"},
+	ProtocolName:     "wssh",
 	ConvertMultiaddr: ConvertWebsocketMultiaddrToNetAddr,
 	ParseNetAddr:     ParseWebsocketNetAddr,
 }
 
-// This is _not_ WsFmt because we want the transport to stick to dialing fully
-// resolved addresses.
-var dialMatcher = mafmt.And(mafmt.IP, mafmt.Base(ma.P_TCP), mafmt.Base(ma.P_WS))
+// dialHosts are IPs or DNS names - the name is kept for SNI and virtual
+// hosting. /dnsaddr is resolved before dialing.
+var dialHosts = mafmt.Or(mafmt.IP, mafmt.Base(ma.P_DNS), mafmt.DNS4, mafmt.DNS6)
+
+var dialMatcher = mafmt.And(dialHosts, mafmt.Base(ma.P_TCP), wsProtocols)
+
+// sshDialMatcher matches plain TCP addresses - /ip4/.../tcp/.../ssh.
+var sshDialMatcher = mafmt.And(dialHosts, mafmt.Base(ma.P_TCP), mafmt.Base(P_SSH))
 
 
 func init() {
 	manet.RegisterNetCodec(WsCodec)
 	ma.AddProtocol(ma.Protocol{
-		Name:  "ws",
-		Code:  ma.P_WS,
-		VCode: ma.CodeToVarint(ma.P_WS),
+		Name:  "wssh",
+		Code:  P_WSSH,
+		VCode: ma.CodeToVarint(P_WSSH),
+	})
+	ma.AddProtocol(ma.Protocol{
+		Name:  "ssh",
+		Code:  P_SSH,
+		VCode: ma.CodeToVarint(P_SSH),
 	})
+	if ma.ProtocolWithCode(P_HTTP_PATH).Code == 0 {
+		ma.AddProtocol(ma.Protocol{
+			Name:       "http-path",
+			Code:       P_HTTP_PATH,
+			VCode:      ma.CodeToVarint(P_HTTP_PATH),
+			Size:       ma.LengthPrefixedVarSize,
+			Transcoder: httpPathTranscoder,
+		})
+	}
+	if ma.ProtocolWithCode(P_TLS).Code == 0 {
+		ma.AddProtocol(ma.Protocol{
+			Name:  "tls",
+			Code:  P_TLS,
+			VCode: ma.CodeToVarint(P_TLS),
+		})
+	}
 }
 
 
@@ -43,7 +102,7 @@ type Addr struct {
 
 var _ net.Addr = (*Addr)(nil)
 
-// Network returns the network type for a WebSocket, "websocket".
+// Network returns the network type for SSH over WebSocket, "wssh".
 func (addr *Addr) Network() string {
 	return "wssh"
 }
@@ -82,12 +141,31 @@ func ParseWebsocketNetAddr(a net.Addr) (ma.Multiaddr, error) {
 		return nil, err
 	}
 
-	wsma, err := ma.NewMultiaddr("/wssh")
+	return tcpma.Encapsulate(ma.StringCast("/wssh")), nil
+}
+
+var httpPathTranscoder = ma.NewTranscoderFromFunctions(
+	func(s string) ([]byte, error) {
+		p, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(p), nil
+	},
+	func(b []byte) (string, error) {
+		return url.PathEscape(string(b)), nil
+	},
+	nil)
+
+// httpPath returns the URL path of an address, "/" if it has no /http-path.
+func httpPath(a ma.Multiaddr) string {
+	p, err := a.ValueForProtocol(P_HTTP_PATH)
 	if err != nil {
-		return nil, err
+		return "/"
 	}
-
-	return tcpma.Encapsulate(wsma), nil
+	// The value is escaped in the string form.
+	p, _ = url.PathUnescape(p)
+	return "/" + strings.TrimPrefix(p, "/")
 }
 
 func parseMultiaddr(a ma.Multiaddr) (string, error) {
@@ -96,5 +174,69 @@ func parseMultiaddr(a ma.Multiaddr) (string, error) {
 		return "", err
 	}
 
-	return "ws://" + host, nil
+	if isSecureWs(a) {
+		return "wss://" + host + httpPath(a), nil
+	}
+	return "ws://" + host + httpPath(a), nil
+}
+
+// isSecureWs returns true for /wss and /tls/ws addresses.
+func isSecureWs(a ma.Multiaddr) bool {
+	secure := false
+	ma.ForEach(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_WSS, P_TLS:
+			secure = true
+			return false
+		}
+		return true
+	})
+	return secure
+}
+
+// wsSuffix returns the WebSocket part of a listen address, /wssh by default.
+func wsSuffix(a ma.Multiaddr) ma.Multiaddr {
+	_, suffix := ma.SplitFunc(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_WS, ma.P_WSS, P_TLS, P_WSSH, P_HTTP_PATH:
+			return true
+		}
+		return false
+	})
+	if suffix == nil {
+		return ma.StringCast("/wssh")
+	}
+	return suffix
+}
+
+// splitP2P removes a trailing /p2p/<id> from a dial address, returning the ID.
+func splitP2P(a ma.Multiaddr) (ma.Multiaddr, peer.ID, error) {
+	rest, last := ma.SplitLast(a)
+	if last == nil || last.Protocol().Code != ma.P_P2P {
+		return a, "", nil
+	}
+	if rest == nil {
+		return nil, "", fmt.Errorf("no address for %s", a)
+	}
+	id, err := peer.IDFromBytes(last.RawValue())
+	if err != nil {
+		return nil, "", err
+	}
+	return rest, id, nil
+}
+
+// connMultiaddrs returns the multiaddrs of a connection, as returned by the
+// listener - plain TCP connections get the /ssh suffix.
+func connMultiaddrs(nc net.Conn) (ma.Multiaddr, ma.Multiaddr) {
+	addr := func(a net.Addr) ma.Multiaddr {
+		m, err := manet.FromNetAddr(a)
+		if err != nil {
+			return nil
+		}
+		if _, last := ma.SplitLast(m); last != nil && last.Protocol().Code == ma.P_TCP {
+			m = m.Encapsulate(ma.StringCast("/ssh"))
+		}
+		return m
+	}
+	return addr(nc.LocalAddr()), addr(nc.RemoteAddr())
 }
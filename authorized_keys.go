@@ -0,0 +1,227 @@
+package wstransport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeys is an allowlist for inbound connections, using the OpenSSH
+// authorized_keys format. Keys are matched by the derived peer ID.
+//
+// Supported options:
+// - from="cidr,..." - source addresses, entries starting with ! are denied
+// - expiry-time="YYYYMMDD[HHMM[SS]][Z]" - the entry is ignored after the time
+// - restrict, permitopen="host:port" - recorded in the permissions
+// - protocols="id,..." - libp2p protocols the peer may use, recorded
+//
+// The options of the matching entry are added to the Extensions of the
+// connection ssh.Permissions.
+type AuthorizedKeys struct {
+	// File in authorized_keys format. It is reloaded when modified.
+	File string
+
+	// Peers are allowed in addition to the keys in File, without options.
+	Peers []peer.ID
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	entries []*authorizedKey
+}
+
+type authorizedKey struct {
+	id      peer.ID
+	from    []string
+	expiry  time.Time
+	options map[string]string
+}
+
+// NewAuthorizedKeys returns an allowlist loaded from an authorized_keys
+// file.
+func NewAuthorizedKeys(file string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{File: file}
+	if _, err := ak.load(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// load returns the current entries, reloading the file if it changed.
+func (ak *AuthorizedKeys) load() ([]*authorizedKey, error) {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+	if ak.File == "" {
+		return nil, nil
+	}
+	st, err := os.Stat(ak.File)
+	if err != nil {
+		return nil, err
+	}
+	if st.ModTime().Equal(ak.modTime) && st.Size() == ak.size && ak.entries != nil {
+		return ak.entries, nil
+	}
+	data, err := ioutil.ReadFile(ak.File)
+	if err != nil {
+		return nil, err
+	}
+	ak.entries = parseAuthorizedKeys(data)
+	ak.modTime = st.ModTime()
+	ak.size = st.Size()
+	return ak.entries, nil
+}
+
+// parseAuthorizedKeys parses the file, skipping invalid lines like sshd.
+func parseAuthorizedKeys(data []byte) []*authorizedKey {
+	entries := []*authorizedKey{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pub, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			log.Println("authorized_keys: line", n, err)
+			continue
+		}
+		id, _, err := keyIdentity(pub)
+		if err != nil {
+			log.Println("authorized_keys: line", n, err)
+			continue
+		}
+		e, err := parseAuthorizedOptions(id, options)
+		if err != nil {
+			log.Println("authorized_keys: line", n, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func parseAuthorizedOptions(id peer.ID, options []string) (*authorizedKey, error) {
+	e := &authorizedKey{id: id, options: map[string]string{}}
+	for _, o := range options {
+		name, val := o, ""
+		if i := strings.Index(o, "="); i >= 0 {
+			name, val = o[:i], strings.Trim(o[i+1:], "\"")
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "from":
+			e.from = strings.Split(val, ",")
+			for _, f := range e.from {
+				if _, _, err := net.ParseCIDR(strings.TrimPrefix(f, "!")); err != nil &&
+					net.ParseIP(strings.TrimPrefix(f, "!")) == nil {
+					return nil, fmt.Errorf("invalid from %q", f)
+				}
+			}
+		case "expiry-time":
+			t, err := parseExpiryTime(val)
+			if err != nil {
+				return nil, err
+			}
+			e.expiry = t
+		case "permitopen":
+			// May be repeated.
+			if prev, ok := e.options[name]; ok {
+				val = prev + "," + val
+			}
+		}
+		e.options[name] = val
+	}
+	return e, nil
+}
+
+// parseExpiryTime parses the sshd expiry-time format - local time unless
+// the Z suffix is used.
+func parseExpiryTime(val string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(val, "Z") {
+		loc = time.UTC
+		val = strings.TrimSuffix(val, "Z")
+	}
+	for _, f := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(val) == len(f) {
+			return time.ParseInLocation(f, val, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", val)
+}
+
+// check returns the options of the first entry allowing the peer to connect
+// from the remote address.
+func (ak *AuthorizedKeys) check(id peer.ID, remote net.Addr) (map[string]string, error) {
+	for _, p := range ak.Peers {
+		if p == id {
+			return map[string]string{}, nil
+		}
+	}
+	entries, err := ak.load()
+	if err != nil {
+		return nil, err
+	}
+	ip := addrIP(remote)
+	now := time.Now()
+	for _, e := range entries {
+		if e.id != id {
+			continue
+		}
+		if !e.expiry.IsZero() && now.After(e.expiry) {
+			continue
+		}
+		if e.from != nil && !matchFrom(e.from, ip) {
+			continue
+		}
+		return e.options, nil
+	}
+	return nil, fmt.Errorf("peer %s not in authorized keys", id)
+}
+
+// matchFrom returns true if the IP matches one of the patterns and none of
+// the negated ones.
+func matchFrom(patterns []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	allowed := false
+	for _, p := range patterns {
+		neg := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		match := false
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			match = n.Contains(ip)
+		} else {
+			match = net.ParseIP(p).Equal(ip)
+		}
+		if match && neg {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
+
+// addrIP returns the IP of a remote address.
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *Addr:
+		return net.ParseIP(dialHost(a.Host))
+	case nil:
+		return nil
+	}
+	return net.ParseIP(dialHost(a.String()))
+}
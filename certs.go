@@ -0,0 +1,213 @@
+package wstransport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH certificate support.
+//
+// Peers may present certificates signed by one of the trusted UserCAs (when
+// connecting) or HostCAs (when accepting). The libp2p identity is the
+// certified key - unless the certificate lists the peer ID as a principal, in
+// which case the certified key can be any SSH key, for example a short lived
+// key issued by the ops CA. The client uses its peer ID as SSH user, and the
+// dialer expects the dialed peer ID as host principal.
+
+// Extensions set in the permissions of authenticated inbound connections.
+const (
+	permPeerID = "libp2p-peer-id@libp2p.io"
+	permPubKey = "libp2p-public-key@libp2p.io"
+	permSSHKey = "ssh-public-key@libp2p.io"
+)
+
+var errUntrustedCert = errors.New("certificate not signed by a trusted authority")
+
+// AddCertificate adds a certificate for the node key, issued by a CA. Host
+// certificates are presented when accepting connections, user certificates
+// when dialing. The plain key remains available for peers that don't trust
+// the CA.
+func (t *SSHTransport) AddCertificate(cert *ssh.Certificate) error {
+	if !bytes.Equal(cert.Key.Marshal(), t.signer.PublicKey().Marshal()) {
+		return errors.New("certificate is not for the node key")
+	}
+	signer, err := ssh.NewCertSigner(cert, t.signer)
+	if err != nil {
+		return err
+	}
+	switch cert.CertType {
+	case ssh.HostCert:
+		t.hostCert = signer
+	case ssh.UserCert:
+		t.userSigners = []ssh.Signer{signer, t.signer}
+	default:
+		return fmt.Errorf("unknown certificate type %d", cert.CertType)
+	}
+	return nil
+}
+
+func (t *SSHTransport) certChecker() *ssh.CertChecker {
+	return &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return hasKey(t.UserCAs, auth)
+		},
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return hasKey(t.HostCAs, auth)
+		},
+		SupportedCriticalOptions: t.CertCriticalOptions,
+	}
+}
+
+func hasKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	kb := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), kb) {
+			return true
+		}
+	}
+	return false
+}
+
+// userIdentity returns the identity of a connecting peer, with permissions
+// recording it.
+func (t *SSHTransport) userIdentity(conn ssh.ConnMetadata, key ssh.PublicKey) (peer.ID, ic.PubKey, *ssh.Permissions, error) {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	var id peer.ID
+	var pk ic.PubKey
+	var err error
+
+	cert, ok := key.(*ssh.Certificate)
+	if ok && hasKey(t.UserCAs, cert.SignatureKey) {
+		// Checks type, principal (the SSH user), validity and options,
+		// including source-address.
+		cperms, cerr := t.certChecker().Authenticate(conn, key)
+		if cerr != nil {
+			return "", nil, nil, cerr
+		}
+		for k, v := range cperms.CriticalOptions {
+			perms.CriticalOptions[k] = v
+		}
+		for k, v := range cperms.Extensions {
+			perms.Extensions[k] = v
+		}
+		id, pk, err = certIdentity(cert, conn.User())
+	} else if ok {
+		if _, self := cert.Extensions[identityExtension]; !self {
+			return "", nil, nil, errUntrustedCert
+		}
+		id, pk, err = keyIdentity(key)
+	} else {
+		id, pk, err = keyIdentity(key)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if t.AuthorizedKeys != nil {
+		opts, err := t.AuthorizedKeys.check(id, conn.RemoteAddr())
+		if err != nil {
+			return "", nil, nil, err
+		}
+		for k, v := range opts {
+			perms.Extensions[k] = v
+		}
+	}
+
+	pkb, err := ic.MarshalPublicKey(pk)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	perms.Extensions[permPeerID] = string(id)
+	perms.Extensions[permPubKey] = string(pkb)
+	perms.Extensions[permSSHKey] = string(key.Marshal())
+	return id, pk, perms, nil
+}
+
+// hostIdentity returns the identity of the server we dialed. host is the
+// dialed host name or IP, if known.
+func (t *SSHTransport) hostIdentity(host string, p peer.ID, key ssh.PublicKey) (peer.ID, ic.PubKey, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return keyIdentity(key)
+	}
+	if !hasKey(t.HostCAs, cert.SignatureKey) {
+		if _, self := cert.Extensions[identityExtension]; self {
+			return keyIdentity(key)
+		}
+		return "", nil, errUntrustedCert
+	}
+	if cert.CertType != ssh.HostCert {
+		return "", nil, fmt.Errorf("certificate type %d is not a host certificate", cert.CertType)
+	}
+	checker := t.certChecker()
+	err := checker.CheckCert(p.String(), cert)
+	if err != nil && host != "" {
+		err = checker.CheckCert(host, cert)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return certIdentity(cert, p.String())
+}
+
+// certIdentity maps a validated certificate to a libp2p identity. If the
+// principal is a peer ID listed in the certificate it is used, otherwise the
+// identity is the certified key. A peer ID that doesn't embed its key must
+// match the certified key.
+func certIdentity(cert *ssh.Certificate, principal string) (peer.ID, ic.PubKey, error) {
+	for _, vp := range cert.ValidPrincipals {
+		if vp != principal {
+			continue
+		}
+		id, err := peer.Decode(principal)
+		if err != nil {
+			break
+		}
+		// Hashed IDs (RSA) don't include the key - the certified key must
+		// be the one the ID is derived from.
+		pk, err := id.ExtractPublicKey()
+		if err != nil || pk == nil {
+			pk, err = SSH2PubKey(cert.Key)
+			if err != nil {
+				return "", nil, err
+			}
+			if !id.MatchesPublicKey(pk) {
+				return "", nil, fmt.Errorf("certified key does not match principal %s", id)
+			}
+		}
+		return id, pk, nil
+	}
+	return keyIdentity(cert.Key)
+}
+
+// keyIdentity returns the identity derived from the key itself.
+func keyIdentity(key ssh.PublicKey) (peer.ID, ic.PubKey, error) {
+	pk, err := SSH2PubKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, pk, nil
+}
+
+// dialHost returns the host part of a dialed address, for host certificate
+// principals.
+func dialHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
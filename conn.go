@@ -1,8 +1,11 @@
 package wstransport
 
 import (
-	"crypto/ed25519"
+	"context"
+	"errors"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
@@ -11,10 +14,14 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/transport"
 	ma "github.com/multiformats/go-multiaddr"
-	manet "github.com/multiformats/go-multiaddr/net"
 	"golang.org/x/crypto/ssh"
 )
 
+var _ network.Conn = (*SSHConn)(nil)
+
+// connIDs is the last connection ID.
+var connIDs uint64
+
 // Conn is a connection to a remote peer,
 // implements CapableConn (	MuxedConn, network.ConnSecurity, network.ConnMultiaddrs
 // Transport())
@@ -32,13 +39,16 @@ type SSHConn struct {
 	scl *ssh.Client
 
 
-	streamQueue chan ssh.Channel
+	streamQueue chan *stream
 
 	closed chan struct{}
 
 	// Original con, with remote/local addr
 	wsCon     net.Conn
 
+	// Multiaddrs of the connection - the dialed address for outbound.
+	laddr, raddr ma.Multiaddr
+
 	inChans   <-chan ssh.NewChannel
 	req       <-chan *ssh.Request
 
@@ -48,9 +58,37 @@ type SSHConn struct {
 	// Includes the private key of this node
 	t         *SSHTransport // transport.Transport
 
+	// Key used in the handshake - may be a *ssh.Certificate.
 	remotePub ssh.PublicKey
 
+	remoteID  peer.ID
+	remoteKey ic.PubKey
+
 	stat network.Stat
+
+	kex *kexSniffer
+
+	closeOnce sync.Once
+
+	// Unique in the process.
+	id uint64
+
+	// Open streams, also for draining.
+	streamsMu  sync.Mutex
+	streams    map[*stream]struct{}
+	nextStream uint64
+	draining   bool
+	idle       chan struct{}
+
+	// Resource manager scope, nil if not used.
+	scope     ConnManagementScope
+	scopeOnce sync.Once
+
+	// Inbound stream counts, guarded by the transport streamLimitMu.
+	inStreams       streamCount
+	streamsReleased bool
+
+	tracking
 }
 
 func (c *SSHConn) LocalPeer() peer.ID {
@@ -63,28 +101,54 @@ func (c *SSHConn) LocalPrivateKey() ic.PrivKey {
 }
 
 func (c *SSHConn) RemotePeer() peer.ID {
-	p, _ := peer.IDFromPublicKey(c.RemotePublicKey())
-	return p
+	return c.remoteID
 }
 
 func (c *SSHConn) RemotePublicKey() ic.PubKey {
-	kb := c.remotePub.(ssh.CryptoPublicKey)
-	pubk := kb.CryptoPublicKey()
-	edk := pubk.(ed25519.PublicKey)
+	return c.remoteKey
+}
 
-	//stdMarshal := c.remotePub.Marshal()
-	pk, _ := ic.UnmarshalEd25519PublicKey(edk)
-	return pk
+// Algorithms returns the algorithms negotiated in the SSH handshake.
+func (c *SSHConn) Algorithms() Algorithms {
+	return c.kex.algorithms()
+}
+
+// Permissions returns the permissions of an inbound connection, including
+// the options of the matching authorized key or certificate. Nil for
+// outbound connections.
+func (c *SSHConn) Permissions() *ssh.Permissions {
+	if c.sc == nil {
+		return nil
+	}
+	return c.sc.Permissions
+}
+
+// setRemoteIdentity sets the identity of an inbound connection, from the
+// permissions of the key that completed auth.
+func (c *SSHConn) setRemoteIdentity(perms *ssh.Permissions) error {
+	if perms == nil || perms.Extensions[permPeerID] == "" {
+		return errors.New("missing remote identity")
+	}
+	pk, err := ic.UnmarshalPublicKey([]byte(perms.Extensions[permPubKey]))
+	if err != nil {
+		return err
+	}
+	key, err := ssh.ParsePublicKey([]byte(perms.Extensions[permSSHKey]))
+	if err != nil {
+		return err
+	}
+	c.remoteID = peer.ID(perms.Extensions[permPeerID])
+	c.remoteKey = pk
+	c.remotePub = key
+	return nil
 }
 
 func (c *SSHConn) LocalMultiaddr() ma.Multiaddr {
-	r, _ := manet.FromNetAddr(c.wsCon.LocalAddr())
-	return r
+	return c.laddr
 }
 
 func (c *SSHConn) RemoteMultiaddr() ma.Multiaddr {
-	r, _ := manet.FromNetAddr(c.wsCon.RemoteAddr())
-	return r
+	return c.raddr
 }
 
 func (c *SSHConn) Transport() transport.Transport {
@@ -94,16 +158,47 @@ func (c *SSHConn) Transport() transport.Transport {
 // The transport can also implements directly the network.Conn
 
 func (c *SSHConn) ID() string {
-	return ""
+	return strconv.FormatUint(c.id, 10)
 }
 
+// GetStreams returns the open streams.
 func (c *SSHConn) GetStreams() []network.Stream {
-	return nil
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	streams := make([]network.Stream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// StreamStats are the statistics of an open stream.
+type StreamStats struct {
+	ID           string
+	Direction    network.Direction
+	Opened       time.Time
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// StreamStats returns the statistics of the open streams.
+func (c *SSHConn) StreamStats() []StreamStats {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	stats := make([]StreamStats, 0, len(c.streams))
+	for s := range c.streams {
+		stats = append(stats, s.stats())
+	}
+	return stats
 }
 
 // Replaces/uses OpenStream used in transport MuxedStream.
 func (c *SSHConn) NewStream() (network.Stream, error) {
-	return nil, nil
+	s, err := c.openStream(context.Background(), newStream(c, network.DirOutbound), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // Return Stat directly - for metadata.
@@ -113,19 +208,14 @@ func (c *SSHConn) Stat() network.Stat {
 
 
 func (c *SSHConn) Close() error {
-	var err error
-	if c.sc != nil {
-		err = c.sc.Close()
-	} else {
-		err = c.scl.Close()
-	}
-	if err != nil {
-		return err
-	}
-	if !c.IsClosed() {
+	c.untrack(c)
+	c.t.releaseStreams(c)
+	defer c.releaseResources()
+	err := c.sshConn().Close()
+	c.closeOnce.Do(func() {
 		close(c.closed)
-	}
-	return nil
+	})
+	return err
 }
 
 func (c *SSHConn) IsClosed() bool {
@@ -137,25 +227,79 @@ func (c *SSHConn) IsClosed() bool {
 	}
 }
 
+// sshConn returns the server or client connection.
+func (c *SSHConn) sshConn() ssh.Conn {
+	if c.sc != nil {
+		return c.sc
+	}
+	return c.scl
+}
 
 // OpenStream creates a new stream.
 // This uses the same channel in both directions.
 func (c *SSHConn) OpenStream() (mux.MuxedStream, error) {
-	if c.sc != nil {
-		s, r, err := c.sc.OpenChannel("direct-tcpip", []byte{})
-		if err != nil {
-			return nil, err
-		}
-		go ssh.DiscardRequests(r)
-		return &stream{ch: s, con: c}, nil
+	s, err := c.openStream(context.Background(), newStream(c, network.DirOutbound), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStream opens the channel of an outbound stream, payload is the stream
+// header - nil for a direct-tcpip channel. If the context is done first, the
+// channel is closed once open.
+func (c *SSHConn) openStream(ctx context.Context, s *stream, payload []byte) (*stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.openScope(); err != nil {
+		return nil, err
+	}
+	if !c.addStream(s) {
+		s.releaseScope()
+		return nil, errDraining
+	}
+	type result struct {
+		ch   ssh.Channel
+		reqs <-chan *ssh.Request
+		err  error
+	}
+	chType := "direct-tcpip"
+	if payload != nil {
+		chType = streamChannelType
+	}
+	open := func() result {
+		ch, reqs, err := c.sshConn().OpenChannel(chType, payload)
+		return result{ch, reqs, err}
+	}
+
+	var r result
+	if ctx.Done() == nil {
+		r = open()
 	} else {
-		s, r, err := c.scl.OpenChannel("direct-tcpip", []byte{})
-		if err != nil {
-			return nil, err
+		rch := make(chan result, 1)
+		go func() {
+			rch <- open()
+		}()
+		select {
+		case r = <-rch:
+		case <-ctx.Done():
+			c.streamDone(s)
+			go func() {
+				if r := <-rch; r.err == nil {
+					go ssh.DiscardRequests(r.reqs)
+					r.ch.Close()
+				}
+			}()
+			return nil, ctx.Err()
 		}
-		go ssh.DiscardRequests(r)
-		return &stream{ch: s, con: c}, nil
 	}
+	if r.err != nil {
+		c.streamDone(s)
+		return nil, r.err
+	}
+	s.attach(r.ch, r.reqs)
+	return s, nil
 }
 
 // AcceptStream accepts a stream opened by the other side.
@@ -163,11 +307,15 @@ func (c *SSHConn) AcceptStream() (mux.MuxedStream, error) {
 	if c.IsClosed() {
 		return nil, errClosed
 	}
-	select {
-	case <-c.closed:
-		return nil, errClosed
-	case s := <-c.streamQueue:
-		return &stream{ch:s}, nil
+	for {
+		select {
+		case <-c.closed:
+			return nil, errClosed
+		case s := <-c.streamQueue:
+			// Skip streams the remote reset while queued.
+			if c.t.streamAccepted(s) {
+				return s, nil
+			}
+		}
 	}
 }
-
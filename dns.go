@@ -0,0 +1,121 @@
+package wstransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DNS multiaddrs. /dns, /dns4 and /dns6 names are passed to the dialer - the
+// name is used in the WS URL, for SNI and virtual hosting. /dnsaddr is
+// resolved to addresses using TXT records, as described in
+// https://github.com/multiformats/multiaddr/blob/master/protocols/DNSADDR.md
+
+// Resolver looks up TXT records for /dnsaddr. *net.Resolver implements it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// maxDNSAddrDepth bounds the /dnsaddr recursion.
+const maxDNSAddrDepth = 4
+
+var errNoAddrs = errors.New("dnsaddr: no dialable addresses")
+
+func (t *SSHTransport) resolver() Resolver {
+	if t.Resolver != nil {
+		return t.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Resolve returns the dialable addresses for a /dnsaddr multiaddr, keeping
+// the ones for the peer if the address ends with /p2p. Other addresses are
+// returned as is.
+func (t *SSHTransport) Resolve(ctx context.Context, a ma.Multiaddr) ([]ma.Multiaddr, error) {
+	if !isDNSAddr(a) {
+		return []ma.Multiaddr{a}, nil
+	}
+	_, id, err := splitP2P(a)
+	if err != nil {
+		return nil, err
+	}
+	res := []ma.Multiaddr{}
+	if err := t.resolveDNSAddr(ctx, a, id, 0, &res); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%w for %s", errNoAddrs, a)
+	}
+	return res, nil
+}
+
+func (t *SSHTransport) resolveDNSAddr(ctx context.Context, a ma.Multiaddr, id peer.ID, depth int, res *[]ma.Multiaddr) error {
+	if depth > maxDNSAddrDepth {
+		return fmt.Errorf("dnsaddr: too many levels resolving %s", a)
+	}
+	name, err := a.ValueForProtocol(ma.P_DNSADDR)
+	if err != nil {
+		return err
+	}
+	txts, err := t.resolver().LookupTXT(ctx, "_dnsaddr."+name)
+	if err != nil {
+		return err
+	}
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "dnsaddr=") {
+			continue
+		}
+		ra, err := ma.NewMultiaddr(strings.TrimPrefix(txt, "dnsaddr="))
+		if err != nil {
+			continue
+		}
+		_, rid, err := splitP2P(ra)
+		if err != nil || (id != "" && rid != "" && rid != id) {
+			continue
+		}
+		if isDNSAddr(ra) {
+			if err := t.resolveDNSAddr(ctx, ra, id, depth+1, res); err != nil {
+				return err
+			}
+			continue
+		}
+		if t.CanDial(ra) {
+			*res = append(*res, ra)
+		}
+	}
+	return nil
+}
+
+// dialDNSAddr dials the addresses of a /dnsaddr in order, returning the
+// first connection. Its RemoteMultiaddr is the resolved address.
+func (t *SSHTransport) dialDNSAddr(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if p != "" {
+		raddr = raddr.Encapsulate(ma.StringCast("/p2p/" + p.Pretty()))
+	}
+	addrs, err := t.Resolve(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var c transport.CapableConn
+		c, err = t.Dial(ctx, a, p)
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func isDNSAddr(a ma.Multiaddr) bool {
+	first, _ := ma.SplitFirst(a)
+	return first != nil && first.Protocol().Code == ma.P_DNSADDR
+}
@@ -0,0 +1,277 @@
+package wstransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/transport"
+)
+
+// Graceful shutdown. Closing stops accepting, and tells the peers with a
+// goAwayRequest - the ssh package doesn't expose SSH_MSG_DISCONNECT. Peers
+// stop opening streams, the open ones can finish until the context is done,
+// then the connections are closed.
+
+// goAwayRequest is the global request sent before closing a connection.
+const goAwayRequest = "goaway@libp2p.io"
+
+var errDraining = errors.New("conn is going away")
+
+var errTransportClosed = errors.New("transport closed")
+
+// shutdowner is a connection that can be closed gracefully.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// connSet is a set of open connections.
+type connSet struct {
+	mu sync.Mutex
+	m  map[shutdowner]struct{}
+}
+
+func (s *connSet) add(c shutdowner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = map[shutdowner]struct{}{}
+	}
+	s.m[c] = struct{}{}
+}
+
+func (s *connSet) remove(c shutdowner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, c)
+}
+
+// shutdown drains all connections in parallel.
+func (s *connSet) shutdown(ctx context.Context) {
+	s.mu.Lock()
+	conns := make([]shutdowner, 0, len(s.m))
+	for c := range s.m {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c shutdowner) {
+			defer wg.Done()
+			c.Shutdown(ctx)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// tracking records the sets a connection is in, to remove it when closed.
+type tracking struct {
+	trackMu sync.Mutex
+	done    bool
+	sets    []*connSet
+}
+
+// trackIn adds the connection to the set, unless already closed.
+func (tr *tracking) trackIn(s *connSet, c shutdowner) {
+	tr.trackMu.Lock()
+	defer tr.trackMu.Unlock()
+	if tr.done {
+		return
+	}
+	s.add(c)
+	tr.sets = append(tr.sets, s)
+}
+
+func (tr *tracking) untrack(c shutdowner) {
+	tr.trackMu.Lock()
+	defer tr.trackMu.Unlock()
+	tr.done = true
+	for _, s := range tr.sets {
+		s.remove(c)
+	}
+	tr.sets = nil
+}
+
+// Shutdown stops new streams, waits for the open ones to be closed or the
+// context to be done, and closes the connection.
+func (c *SSHConn) Shutdown(ctx context.Context) error {
+	idle := c.startDrain()
+	c.sshConn().SendRequest(goAwayRequest, false, nil)
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	case <-c.closed:
+	}
+	return c.Close()
+}
+
+// startDrain rejects new streams, returning a channel closed when the open
+// streams are done.
+func (c *SSHConn) startDrain() chan struct{} {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	c.draining = true
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+		if len(c.streams) == 0 {
+			close(c.idle)
+		}
+	}
+	return c.idle
+}
+
+// addStream registers a new stream and sets its ID, unless draining.
+func (c *SSHConn) addStream(s *stream) bool {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if c.draining {
+		return false
+	}
+	if c.streams == nil {
+		c.streams = map[*stream]struct{}{}
+	}
+	c.nextStream++
+	s.id = c.nextStream
+	c.streams[s] = struct{}{}
+	return true
+}
+
+func (c *SSHConn) streamDone(s *stream) {
+	s.releaseScope()
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if _, ok := c.streams[s]; !ok {
+		return
+	}
+	delete(c.streams, s)
+	if len(c.streams) == 0 && c.idle != nil {
+		close(c.idle)
+	}
+}
+
+// fallbackConn tracks a connection using the libp2p upgrader. Its muxers
+// have no graceful close.
+type fallbackConn struct {
+	transport.CapableConn
+	tracking
+
+	scope     ConnManagementScope
+	scopeOnce sync.Once
+}
+
+func (c *fallbackConn) Shutdown(ctx context.Context) error {
+	return c.Close()
+}
+
+func (c *fallbackConn) Close() error {
+	c.untrack(c)
+	err := c.CapableConn.Close()
+	c.scopeOnce.Do(func() {
+		releaseConnScope(c.scope)
+	})
+	return err
+}
+
+// trackConn adds an accepted connection to the set.
+func trackConn(s *connSet, cc transport.CapableConn) {
+	switch c := cc.(type) {
+	case *SSHConn:
+		c.trackIn(s, c)
+	case *fallbackConn:
+		c.trackIn(s, c)
+	}
+}
+
+// Shutdown closes the listener and drains the connections it accepted.
+func (l *listener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+	l.conns.shutdown(ctx)
+	return err
+}
+
+// Close stops listening and accepting, and gracefully closes all
+// connections - open streams may finish until the context is done.
+func (t *SSHTransport) Close(ctx context.Context) error {
+	t.connsMu.Lock()
+	t.isClosed = true
+	listeners := make([]*listener, 0, len(t.listeners))
+	for l := range t.listeners {
+		listeners = append(listeners, l)
+	}
+	t.connsMu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	t.conns.shutdown(ctx)
+	return nil
+}
+
+// addListener tracks a listener, failing if the transport is closed.
+func (t *SSHTransport) addListener(l *listener) error {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.isClosed {
+		return errTransportClosed
+	}
+	if t.listeners == nil {
+		t.listeners = map[*listener]struct{}{}
+	}
+	t.listeners[l] = struct{}{}
+	return nil
+}
+
+func (t *SSHTransport) removeListener(l *listener) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	delete(t.listeners, l)
+}
+
+func (t *SSHTransport) closedErr() error {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.isClosed {
+		return errTransportClosed
+	}
+	return nil
+}
+
+// inflight tracks raw connections in handshake, closed with the listener.
+type inflight struct {
+	mu     sync.Mutex
+	m      map[net.Conn]struct{}
+	closed bool
+}
+
+// add tracks the connection, returning false if the listener is closed.
+func (f *inflight) add(nc net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	if f.m == nil {
+		f.m = map[net.Conn]struct{}{}
+	}
+	f.m[nc] = struct{}{}
+	return true
+}
+
+func (f *inflight) remove(nc net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.m, nc)
+}
+
+func (f *inflight) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for nc := range f.m {
+		closeWithReason(nc, "listener closed")
+	}
+	f.m = nil
+	f.closed = true
+}
@@ -0,0 +1,180 @@
+package wstransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	csms "github.com/libp2p/go-conn-security-multistream"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	mplex "github.com/libp2p/go-libp2p-mplex"
+	libp2ptls "github.com/libp2p/go-libp2p-tls"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	msmux "github.com/libp2p/go-stream-muxer-multistream"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Fallback for peers using the stock libp2p ws transport, which don't
+// negotiate the PROTO_SSH subprotocol: the connection is upgraded with
+// multistream-select, TLS and yamux or mplex, like go-libp2p does.
+//
+// The Gater and AuthorizedKeys apply to fallback connections as well. The
+// CryptoPolicy, certificates and KnownHosts are SSH specific and don't. TLS
+// needs the peer ID of the remote - dials without it, allowed for SSH by
+// AllowAnyPeer or KnownHosts, fail.
+
+// libp2pUpgrader returns the upgrader for fallback connections.
+func (t *SSHTransport) libp2pUpgrader() (*tptu.Upgrader, error) {
+	t.upgraderOnce.Do(func() {
+		tls, err := libp2ptls.New(t.Key)
+		if err != nil {
+			t.upgraderErr = err
+			return
+		}
+		sec := new(csms.SSMuxer)
+		sec.AddTransport(libp2ptls.ID, tls)
+
+		muxer := msmux.NewBlankTransport()
+		muxer.AddTransport("/yamux/1.0.0", yamux.DefaultTransport)
+		muxer.AddTransport("/mplex/6.7.0", mplex.DefaultTransport)
+
+		t.upgrader = &tptu.Upgrader{
+			PSK:    t.Psk,
+			Secure: sec,
+			Muxer:  muxer,
+		}
+	})
+	return t.upgrader, t.upgraderErr
+}
+
+// upgradeLibp2p runs the standard libp2p handshake on a connection without
+// SSH. raddr is the dialed address, nil for inbound connections.
+func (t *SSHTransport) upgradeLibp2p(nc net.Conn, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if t.DisableFallback {
+		nc.Close()
+		return nil, errNoFallback
+	}
+	u, err := t.libp2pUpgrader()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	mc := &maConn{Conn: nc}
+	mc.laddr, mc.raddr = connMultiaddrs(nc)
+	if raddr != nil {
+		mc.raddr = raddr
+	}
+
+	dir := network.DirOutbound
+	if raddr == nil {
+		dir = network.DirInbound
+	} else if p == "" {
+		nc.Close()
+		return nil, errFallbackNoPeerID
+	}
+	scope, err := t.openConnScope(dir, mc.raddr)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	fc, err := t.upgradeFallback(u, mc, dir, p)
+	if err != nil {
+		// The upgrader doesn't close on all errors.
+		nc.Close()
+		releaseConnScope(scope)
+		return nil, err
+	}
+	if err := setScopePeer(scope, fc.RemotePeer()); err != nil {
+		fc.CapableConn.Close()
+		releaseConnScope(scope)
+		return nil, err
+	}
+	fc.scope = scope
+	fc.trackIn(&t.conns, fc)
+	return fc, nil
+}
+
+// upgradeFallback runs the libp2p upgrade and the checks of the transport.
+func (t *SSHTransport) upgradeFallback(u *tptu.Upgrader, mc *maConn, dir network.Direction, p peer.ID) (*fallbackConn, error) {
+	nc := mc.Conn
+	ctx, cancel := context.WithTimeout(context.Background(), t.handshakeTimeout())
+	defer cancel()
+	nc.SetDeadline(time.Now().Add(t.handshakeTimeout()))
+
+	var c transport.CapableConn
+	var err error
+	if dir == network.DirInbound {
+		c, err = u.UpgradeInbound(ctx, t, mc)
+	} else {
+		c, err = u.UpgradeOutbound(ctx, t, mc, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	if dir == network.DirInbound && t.AuthorizedKeys != nil {
+		if _, err := t.AuthorizedKeys.check(c.RemotePeer(), nc.RemoteAddr()); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if t.Gater != nil {
+		if !t.Gater.InterceptSecured(dir, c.RemotePeer(), c) {
+			c.Close()
+			return nil, errGated
+		}
+		if allow, _ := t.Gater.InterceptUpgraded(&upgradedConn{c, network.Stat{Direction: dir}}); !allow {
+			c.Close()
+			return nil, errGated
+		}
+	}
+	return &fallbackConn{CapableConn: c}, nil
+}
+
+var errFallbackNoPeerID = fmt.Errorf("remote doesn't support %s, the libp2p fallback needs the peer ID", PROTO_SSH)
+
+var errNoFallback = fmt.Errorf("remote doesn't support %s, fallback disabled", PROTO_SSH)
+
+// maConn is a net.Conn with the multiaddrs used by the transport.
+type maConn struct {
+	net.Conn
+	laddr, raddr ma.Multiaddr
+}
+
+func (c *maConn) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *maConn) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
+
+// upgradedConn adds the network.Conn methods to a fallback connection, for
+// InterceptUpgraded. Streams are tracked by the swarm.
+type upgradedConn struct {
+	transport.CapableConn
+	stat network.Stat
+}
+
+func (c *upgradedConn) ID() string {
+	return ""
+}
+
+func (c *upgradedConn) GetStreams() []network.Stream {
+	return nil
+}
+
+func (c *upgradedConn) NewStream() (network.Stream, error) {
+	return nil, errors.New("NewStream not supported before the swarm adds the connection")
+}
+
+func (c *upgradedConn) Stat() network.Stat {
+	return c.stat
+}
@@ -0,0 +1,84 @@
+package wstransport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// errGated is returned when the ConnectionGater rejects a connection.
+var errGated = errors.New("connection gated")
+
+// connAddrs implements network.ConnMultiaddrs for connections that are not
+// yet upgraded - used with InterceptAccept.
+type connAddrs struct {
+	laddr ma.Multiaddr
+	raddr ma.Multiaddr
+}
+
+func (c *connAddrs) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *connAddrs) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
+
+// interceptDial checks an outbound dial with the gater.
+func (t *SSHTransport) interceptDial(raddr ma.Multiaddr, p peer.ID) error {
+	if t.Gater != nil && !(t.Gater.InterceptPeerDial(p) && t.Gater.InterceptAddrDial(p, raddr)) {
+		return fmt.Errorf("%w: dial to %s %s", errGated, p, raddr)
+	}
+	return nil
+}
+
+// requestAddrs returns the multiaddrs of an incoming WS request, before
+// the upgrade.
+func (l *listener) requestAddrs(r *http.Request) (*connAddrs, error) {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := manet.FromNetAddr(tcpaddr)
+	if err != nil {
+		return nil, err
+	}
+	return &connAddrs{
+		laddr: l.laddr,
+		raddr: raddr.Encapsulate(wsSuffix(l.laddr)),
+	}, nil
+}
+
+// reasonCloser is implemented by connections that can send the reason for
+// closing to the remote side - the websocket Conn uses the close frame.
+type reasonCloser interface {
+	CloseWithReason(code int, reason string) error
+}
+
+// closeGated closes a connection rejected by the gater, letting the other
+// side know why.
+func closeGated(nc net.Conn, stage string, reason control.DisconnectReason) {
+	msg := fmt.Sprintf("%s: %s", errGated, stage)
+	if reason != 0 {
+		msg = fmt.Sprintf("%s (reason %d)", msg, reason)
+	}
+	closeWithReason(nc, msg)
+}
+
+// closeWithReason closes nc, sending the reason to the remote side if the
+// connection supports it.
+func closeWithReason(nc net.Conn, reason string) {
+	if rc, ok := nc.(reasonCloser); ok {
+		rc.CloseWithReason(ws.ClosePolicyViolation, reason)
+		return
+	}
+	nc.Close()
+}
@@ -3,13 +3,15 @@ module github.com/costinm/go-libp2p-ssh-transport
 require (
 	github.com/docker/spdystream v0.0.0-20181023171402-6480d4af844c
 	github.com/gorilla/websocket v1.4.2
+	github.com/libp2p/go-conn-security-multistream v0.2.0
 	github.com/libp2p/go-libp2p-core v0.7.0
-	github.com/libp2p/go-libp2p-mplex v0.2.3
+	github.com/libp2p/go-libp2p-mplex v0.3.0
 	github.com/libp2p/go-libp2p-testing v0.3.0
 	github.com/libp2p/go-libp2p-tls v0.1.3
 	github.com/libp2p/go-libp2p-transport-upgrader v0.2.0
 	github.com/libp2p/go-libp2p-yamux v0.4.1
 	github.com/libp2p/go-stream-muxer v0.1.0
+	github.com/libp2p/go-stream-muxer-multistream v0.3.0
 	github.com/multiformats/go-multiaddr v0.3.1
 	github.com/multiformats/go-multiaddr-fmt v0.1.0
 	github.com/whyrusleeping/go-smux-spdystream v0.0.0-20170912225229-a6182ff2a058
@@ -0,0 +1,159 @@
+package wstransport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// Stream header: the protocol ID and optional key/value metadata are sent in
+// the extra data of the channel open, saving the multistream-select round
+// trip. Encoded as SSH strings - the protocol, then keys and values.
+//
+// Streams with a header use their own channel type, the extra data of
+// direct-tcpip is the forwarding target defined by RFC 4254. Streams opened
+// with OpenStream are direct-tcpip, without header.
+
+// streamChannelType is the channel type of streams with a header.
+const streamChannelType = "libp2p-stream@libp2p.io"
+
+// maxStreamHeader is the largest channel open payload accepted.
+const maxStreamHeader = 4096
+
+// StreamRejectedError is returned by CheckStream to refuse a stream with a
+// specific reason, for example ssh.UnknownChannelType for an unsupported
+// protocol. Other errors refuse with ssh.Prohibited.
+type StreamRejectedError struct {
+	Reason  ssh.RejectionReason
+	Message string
+}
+
+func (e *StreamRejectedError) Error() string {
+	return fmt.Sprintf("stream rejected: %s (%s)", e.Message, e.Reason)
+}
+
+var errBadStreamHeader = errors.New("malformed stream header")
+
+func marshalStreamHeader(p protocol.ID, headers map[string]string) []byte {
+	b := appendString(nil, string(p))
+	for k, v := range headers {
+		b = appendString(b, k)
+		b = appendString(b, v)
+	}
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(s)))
+	return append(append(b, l[:]...), s...)
+}
+
+// parseStreamHeader decodes the extra data of a streamChannelType open.
+func parseStreamHeader(b []byte) (protocol.ID, map[string]string, error) {
+	if len(b) > maxStreamHeader {
+		return "", nil, errBadStreamHeader
+	}
+	p, b, ok := parseString(b)
+	if !ok || p == "" {
+		return "", nil, errBadStreamHeader
+	}
+	var headers map[string]string
+	for len(b) > 0 {
+		var k, v string
+		if k, b, ok = parseString(b); !ok {
+			return "", nil, errBadStreamHeader
+		}
+		if v, b, ok = parseString(b); !ok {
+			return "", nil, errBadStreamHeader
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[k] = v
+	}
+	return protocol.ID(p), headers, nil
+}
+
+func parseString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	l := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < l {
+		return "", nil, false
+	}
+	return string(b[:l]), b[l:], true
+}
+
+// checkStream validates the header of an incoming channel, returning the
+// rejection if refused. The extra data of direct-tcpip channels is ignored.
+func (c *SSHConn) checkStream(nc ssh.NewChannel) (protocol.ID, map[string]string, *StreamRejectedError) {
+	var p protocol.ID
+	var headers map[string]string
+	if nc.ChannelType() == streamChannelType {
+		var err error
+		p, headers, err = parseStreamHeader(nc.ExtraData())
+		if err != nil {
+			return "", nil, &StreamRejectedError{ssh.ConnectionFailed, err.Error()}
+		}
+	}
+	if c.t.CheckStream == nil {
+		return p, headers, nil
+	}
+	if err := c.t.CheckStream(c, p, headers); err != nil {
+		if re, ok := err.(*StreamRejectedError); ok {
+			return "", nil, re
+		}
+		return "", nil, &StreamRejectedError{ssh.Prohibited, err.Error()}
+	}
+	return p, headers, nil
+}
+
+// mergeChannels returns the channel opens of both types in one channel, closed
+// when both are. The client side of the ssh package has one channel per type.
+func mergeChannels(a, b <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+	res := make(chan ssh.NewChannel)
+	var wg sync.WaitGroup
+	forward := func(in <-chan ssh.NewChannel) {
+		defer wg.Done()
+		for nc := range in {
+			res <- nc
+		}
+	}
+	wg.Add(2)
+	go forward(a)
+	go forward(b)
+	go func() {
+		wg.Wait()
+		close(res)
+	}()
+	return res
+}
+
+// OpenStreamWithProtocol opens a stream for the protocol, sending it and the
+// headers with the channel open, as a streamChannelType channel. The remote may refuse it, the error is then
+// an *ssh.OpenChannelError with the reason.
+func (c *SSHConn) OpenStreamWithProtocol(ctx context.Context, p protocol.ID, headers map[string]string) (network.Stream, error) {
+	if p == "" {
+		return nil, errors.New("empty protocol")
+	}
+	payload := marshalStreamHeader(p, headers)
+	if len(payload) > maxStreamHeader {
+		return nil, errBadStreamHeader
+	}
+	s := newStream(c, network.DirOutbound)
+	s.proto = p
+	s.headers = headers
+	if _, err := c.openStream(ctx, s, payload); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,96 @@
+package wstransport
+
+import (
+	"net"
+	"sort"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Listeners on unspecified addresses - /ip4/0.0.0.0 or /ip6/:: - report the
+// addresses of the interfaces instead, which peers can dial. They are
+// computed on each call, so interface changes are reflected.
+
+// Multiaddrs returns the dialable addresses of the listener, one per
+// interface address for unspecified listen addresses. Addresses excluded by
+// the transport ExcludeLoopback, ExcludeLinkLocal and ExcludePrivate are
+// skipped. Public addresses are first, loopback last.
+func (l *listener) Multiaddrs() []ma.Multiaddr {
+	if l.laddr == nil || !manet.IsIPUnspecified(l.laddr) {
+		return []ma.Multiaddr{l.laddr}
+	}
+	ifaddrs, err := manet.InterfaceMultiaddrs()
+	if err != nil {
+		return []ma.Multiaddr{l.laddr}
+	}
+	return expandAddr(l.laddr, ifaddrs, l.t.keepListenAddr)
+}
+
+// expandAddr replaces the unspecified IP of laddr with the interface
+// addresses of the same family.
+func expandAddr(laddr ma.Multiaddr, ifaddrs []ma.Multiaddr, keep func(net.IP) bool) []ma.Multiaddr {
+	first, rest := ma.SplitFirst(laddr)
+	res := []ma.Multiaddr{}
+	for _, ia := range ifaddrs {
+		ifirst, _ := ma.SplitFirst(ia)
+		if ifirst == nil || ifirst.Protocol().Code != first.Protocol().Code {
+			continue
+		}
+		if !keep(net.IP(ifirst.RawValue())) {
+			continue
+		}
+		if rest != nil {
+			res = append(res, ifirst.Encapsulate(rest))
+		} else {
+			res = append(res, ifirst)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return addrRank(res[i]) < addrRank(res[j])
+	})
+	return res
+}
+
+func addrRank(a ma.Multiaddr) int {
+	switch {
+	case manet.IsIPLoopback(a):
+		return 3
+	case manet.IsIP6LinkLocal(a):
+		return 2
+	case manet.IsPrivateAddr(a):
+		return 1
+	}
+	return 0
+}
+
+func (t *SSHTransport) keepListenAddr(ip net.IP) bool {
+	switch {
+	case t.ExcludeLoopback && ip.IsLoopback():
+		return false
+	case t.ExcludeLinkLocal && ip.IsLinkLocalUnicast():
+		return false
+	case t.ExcludePrivate && isPrivateIP(ip):
+		return false
+	}
+	return true
+}
+
+// isPrivateIP returns true for the RFC 1918 and RFC 4193 ranges.
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var privateNets = func() []*net.IPNet {
+	res := []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		res = append(res, n)
+	}
+	return res
+}()
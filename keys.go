@@ -0,0 +1,258 @@
+package wstransport
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	crypto_pb "github.com/libp2p/go-libp2p-core/crypto/pb"
+	"golang.org/x/crypto/ssh"
+)
+
+// Conversions between libp2p and SSH keys.
+//
+// Ed25519, RSA and ECDSA map to the standard SSH key types. SSH has no
+// secp256k1 key type - KeyAlgoSecp256k1 is used between our own peers, and
+// since x/crypto/ssh can't negotiate it the handshake uses an ephemeral
+// Ed25519 key, certified by the secp256k1 key (see newIdentitySigner).
+
+// KeyAlgoSecp256k1 is the SSH algorithm name for secp256k1 keys.
+const KeyAlgoSecp256k1 = "ecdsa-sha2-secp256k1@libp2p.io"
+
+// PrivKey2SSH converts a libp2p private key to a SSH signer.
+func PrivKey2SSH(key ic.PrivKey) (ssh.Signer, error) {
+	if key.Type() == crypto_pb.KeyType_Secp256k1 {
+		sk, ok := key.(*ic.Secp256k1PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unexpected secp256k1 key %T", key)
+		}
+		return &secp256k1Signer{key: sk}, nil
+	}
+	std, err := ic.PrivKeyToStdKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if edk, ok := std.(*ed25519.PrivateKey); ok {
+		std = *edk
+	}
+	return ssh.NewSignerFromKey(std)
+}
+
+// SSH2PrivKey converts a private key as returned by ssh.ParseRawPrivateKey
+// to the libp2p representation.
+func SSH2PrivKey(raw interface{}) (ic.PrivKey, error) {
+	switch k := raw.(type) {
+	case ed25519.PrivateKey:
+		raw = &k
+	case *ic.Secp256k1PrivateKey:
+		return k, nil
+	}
+	priv, _, err := ic.KeyPairFromStdKey(raw)
+	return priv, err
+}
+
+// PubKey2SSH converts a libp2p public key to a SSH public key.
+func PubKey2SSH(key ic.PubKey) (ssh.PublicKey, error) {
+	if sk, ok := key.(*ic.Secp256k1PublicKey); ok {
+		return &secp256k1PublicKey{key: sk}, nil
+	}
+	std, err := ic.PubKeyToStdKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(std)
+}
+
+// SSH2PubKey converts the public key presented in the SSH handshake to the
+// libp2p representation.
+func SSH2PubKey(key ssh.PublicKey) (ic.PubKey, error) {
+	switch k := key.(type) {
+	case *secp256k1PublicKey:
+		return k.key, nil
+	case *ssh.Certificate:
+		if _, ok := k.Extensions[identityExtension]; ok {
+			return identityKey(k)
+		}
+		return nil, fmt.Errorf("unsupported ssh certificate for %s", k.Key.Type())
+	}
+
+	kb, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported ssh key type %s", key.Type())
+	}
+	switch pubk := kb.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return ic.UnmarshalEd25519PublicKey(pubk)
+	case *rsa.PublicKey:
+		// PKIX is the libp2p encoding of RSA and ECDSA keys, and works with
+		// the openssl build tag.
+		der, err := x509.MarshalPKIXPublicKey(pubk)
+		if err != nil {
+			return nil, err
+		}
+		return ic.UnmarshalRsaPublicKey(der)
+	case *ecdsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pubk)
+		if err != nil {
+			return nil, err
+		}
+		return ic.UnmarshalECDSAPublicKey(der)
+	}
+	return nil, fmt.Errorf("unsupported ssh key type %s", key.Type())
+}
+
+// secp256k1PublicKey implements ssh.PublicKey. The wire format is the
+// algorithm name followed by the compressed key.
+type secp256k1PublicKey struct {
+	key *ic.Secp256k1PublicKey
+}
+
+type secp256k1WireKey struct {
+	Algo string
+	Key  []byte
+}
+
+func (k *secp256k1PublicKey) Type() string {
+	return KeyAlgoSecp256k1
+}
+
+func (k *secp256k1PublicKey) Marshal() []byte {
+	raw, _ := k.key.Raw()
+	return ssh.Marshal(&secp256k1WireKey{Algo: KeyAlgoSecp256k1, Key: raw})
+}
+
+func (k *secp256k1PublicKey) Verify(data []byte, sig *ssh.Signature) error {
+	if sig.Format != KeyAlgoSecp256k1 {
+		return fmt.Errorf("ssh: signature type %s for key type %s", sig.Format, KeyAlgoSecp256k1)
+	}
+	ok, err := k.key.Verify(data, sig.Blob)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("ssh: signature did not verify")
+	}
+	return nil
+}
+
+// parseSecp256k1PublicKey parses the wire format of a secp256k1 SSH key.
+func parseSecp256k1PublicKey(in []byte) (*secp256k1PublicKey, error) {
+	w := &secp256k1WireKey{}
+	if err := ssh.Unmarshal(in, w); err != nil {
+		return nil, err
+	}
+	if w.Algo != KeyAlgoSecp256k1 {
+		return nil, fmt.Errorf("unexpected key type %s", w.Algo)
+	}
+	pk, err := ic.UnmarshalSecp256k1PublicKey(w.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &secp256k1PublicKey{key: pk.(*ic.Secp256k1PublicKey)}, nil
+}
+
+// secp256k1Signer implements ssh.Signer using the libp2p key - the signature
+// is the DER encoded ECDSA signature over the SHA256 of the data.
+type secp256k1Signer struct {
+	key *ic.Secp256k1PrivateKey
+}
+
+func (s *secp256k1Signer) PublicKey() ssh.PublicKey {
+	return &secp256k1PublicKey{key: s.key.GetPublic().(*ic.Secp256k1PublicKey)}
+}
+
+func (s *secp256k1Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := s.key.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Signature{Format: KeyAlgoSecp256k1, Blob: sig}, nil
+}
+
+// identityExtension is the certificate extension binding an ephemeral SSH
+// key to a libp2p key that can't be used directly in the handshake - similar
+// to the extension used by the libp2p TLS transport.
+const identityExtension = "libp2p-identity@libp2p.io"
+
+const identityPrefix = "libp2p-ssh-identity:"
+
+// identityProof is the value of identityExtension.
+type identityProof struct {
+	// PubKey is the SSH wire format of the libp2p key.
+	PubKey []byte
+	// Signature is the SSH wire format signature of identityPrefix and the
+	// certified key.
+	Signature []byte
+}
+
+// newIdentitySigner returns the signer used in the handshake. For key types
+// SSH can negotiate it is the key itself, otherwise an ephemeral key with a
+// self-signed certificate carrying the identity proof.
+func newIdentitySigner(key ic.PrivKey) (ssh.Signer, error) {
+	signer, err := PrivKey2SSH(key)
+	if err != nil {
+		return nil, err
+	}
+	if key.Type() != crypto_pb.KeyType_Secp256k1 {
+		return signer, nil
+	}
+
+	_, edk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ssh.NewSignerFromKey(edk)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(rand.Reader, append([]byte(identityPrefix), eph.PublicKey().Marshal()...))
+	if err != nil {
+		return nil, err
+	}
+	proof := &identityProof{
+		PubKey:    signer.PublicKey().Marshal(),
+		Signature: ssh.Marshal(sig),
+	}
+	cert := &ssh.Certificate{
+		Key:         eph.PublicKey(),
+		CertType:    ssh.UserCert,
+		ValidBefore: ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				identityExtension: string(ssh.Marshal(proof)),
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, eph); err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(cert, eph)
+}
+
+// identityKey verifies the identity proof in a certificate created by
+// newIdentitySigner and returns the certified libp2p key. The SSH handshake
+// proves possession of the certificate key.
+func identityKey(cert *ssh.Certificate) (ic.PubKey, error) {
+	proof := &identityProof{}
+	if err := ssh.Unmarshal([]byte(cert.Extensions[identityExtension]), proof); err != nil {
+		return nil, err
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(proof.Signature, sig); err != nil {
+		return nil, err
+	}
+	pk, err := parseSecp256k1PublicKey(proof.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := pk.Verify(append([]byte(identityPrefix), cert.Key.Marshal()...), sig); err != nil {
+		return nil, fmt.Errorf("invalid identity proof: %w", err)
+	}
+	return pk.key, nil
+}
@@ -0,0 +1,242 @@
+package wstransport
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/ssh"
+)
+
+// tcpPipe returns both ends of a loopback TCP connection.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+// handshake connects a client and server transport over a TCP pipe.
+func handshake(t *testing.T, client, server *SSHTransport) (*SSHConn, *SSHConn, error) {
+	c1, c2 := tcpPipe(t)
+	serverID, _ := peer.IDFromPrivateKey(server.Key)
+	type result struct {
+		c   *SSHConn
+		err error
+	}
+	sch := make(chan result, 1)
+	go func() {
+		sc, err := server.newCapableConn(c2, true, nil, "")
+		sch <- result{sc, err}
+	}()
+	cc, err := client.newCapableConn(c1, false, nil, serverID)
+	sr := <-sch
+	if err == nil {
+		err = sr.err
+	}
+	return cc, sr.c, err
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, kt := range []int{ic.Ed25519, ic.RSA, ic.ECDSA, ic.Secp256k1} {
+		priv, pub, err := ic.GenerateKeyPair(kt, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := peer.IDFromPublicKey(pub)
+
+		sshPub, err := PubKey2SSH(pub)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		pub2, err := SSH2PubKey(sshPub)
+		if err != nil || !pub2.Equals(pub) {
+			t.Fatal(kt, "public key round trip", err)
+		}
+		signer, err := PrivKey2SSH(priv)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		sig, err := signer.Sign(rand.Reader, []byte("data"))
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if err := sshPub.Verify([]byte("data"), sig); err != nil {
+			t.Fatal(kt, err)
+		}
+
+		st, err := NewSSHTransport(priv, nil, nil)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		ct, err := NewSSHTransport(priv, nil, nil)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if kt == ic.RSA {
+			if _, _, err := handshake(t, ct, st); err == nil {
+				t.Fatal("RSA not allowed by the default policy")
+			}
+			if _, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wssh")); !errors.Is(err, errPolicyKey) {
+				t.Fatal("RSA listen with the default policy", err)
+			}
+			if err := st.SetCryptoPolicy(FIPSCryptoPolicy()); !errors.Is(err, errPolicyKey) {
+				t.Fatal("RSA not allowed by the FIPS policy", err)
+			}
+			if err := st.SetCryptoPolicy(CompatibleCryptoPolicy()); err != nil {
+				t.Fatal(err)
+			}
+			ct.CryptoPolicy = CompatibleCryptoPolicy()
+		}
+		cc, sc, err := handshake(t, ct, st)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if cc.RemotePeer() != id || sc.RemotePeer() != id {
+			t.Fatal(kt, "unexpected remote peer", cc.RemotePeer(), sc.RemotePeer(), id)
+		}
+		cc.Close()
+		sc.Close()
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+
+	newNode := func() *SSHTransport {
+		priv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+		st, err := NewSSHTransport(priv, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	certify := func(st *SSHTransport, certType uint32, validBefore time.Time) {
+		id, _ := peer.IDFromPrivateKey(st.Key)
+		cert := &ssh.Certificate{
+			Key:             st.signer.PublicKey(),
+			CertType:        certType,
+			ValidPrincipals: []string{id.String()},
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.AddCertificate(cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, client := newNode(), newNode()
+	server.UserCAs = []ssh.PublicKey{ca.PublicKey()}
+	client.HostCAs = []ssh.PublicKey{ca.PublicKey()}
+	certify(server, ssh.HostCert, time.Now().Add(time.Hour))
+	certify(client, ssh.UserCert, time.Now().Add(time.Hour))
+
+	cc, sc, err := handshake(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cc.remotePub.(*ssh.Certificate); !ok {
+		t.Fatal("expected host certificate", cc.remotePub.Type())
+	}
+	if _, ok := sc.remotePub.(*ssh.Certificate); !ok {
+		t.Fatal("expected user certificate", sc.remotePub.Type())
+	}
+	if sc.RemotePeer() != cc.LocalPeer() || cc.RemotePeer() != sc.LocalPeer() {
+		t.Fatal("unexpected identity")
+	}
+	cc.Close()
+	sc.Close()
+
+	// Expired host certificate.
+	server = newNode()
+	certify(server, ssh.HostCert, time.Now().Add(-time.Hour))
+	if _, _, err := handshake(t, client, server); err == nil {
+		t.Fatal("expired certificate accepted")
+	}
+
+	// A hashed (RSA) peer ID can only be certified for its own key.
+	_, rsaPub, _ := ic.GenerateKeyPair(ic.RSA, 2048)
+	rsaID, _ := peer.IDFromPublicKey(rsaPub)
+	rsaKey, _ := PubKey2SSH(rsaPub)
+	cert := &ssh.Certificate{Key: rsaKey, ValidPrincipals: []string{rsaID.String()}}
+	if id, pk, err := certIdentity(cert, rsaID.String()); err != nil || id != rsaID || !pk.Equals(rsaPub) {
+		t.Fatal("RSA principal", id, err)
+	}
+	cert.Key = client.signer.PublicKey()
+	if _, _, err := certIdentity(cert, rsaID.String()); err == nil {
+		t.Fatal("certified key not matching the principal accepted")
+	}
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	spriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	server, _ := NewSSHTransport(spriv, nil, nil)
+	cpriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	client, _ := NewSSHTransport(cpriv, nil, nil)
+
+	line := string(ssh.MarshalAuthorizedKey(client.signer.PublicKey()))
+	dir, err := ioutil.TempDir("", "authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "authorized_keys")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# test\nrestrict,protocols=\"/ipfs/id/1.0.0\",from=\"127.0.0.0/8\" " + line)
+	ak, err := NewAuthorizedKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AuthorizedKeys = ak
+
+	_, sc, err := handshake(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Permissions().Extensions["protocols"] != "/ipfs/id/1.0.0" {
+		t.Fatal("missing options", sc.Permissions().Extensions)
+	}
+	sc.Close()
+
+	// Reloaded without restart.
+	write("from=\"10.0.0.0/8\" " + line)
+	if _, _, err := handshake(t, client, server); err == nil {
+		t.Fatal("connection from denied address accepted")
+	}
+	write("expiry-time=\"20200101\" " + line)
+	if _, _, err := handshake(t, client, server); err == nil {
+		t.Fatal("expired key accepted")
+	}
+
+	cid, _ := peer.IDFromPrivateKey(cpriv)
+	ak.Peers = []peer.ID{cid}
+	if _, _, err := handshake(t, client, server); err != nil {
+		t.Fatal(err)
+	}
+}
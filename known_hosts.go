@@ -0,0 +1,105 @@
+package wstransport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHosts is a trust-on-first-use store for dials without a peer ID, in
+// OpenSSH known_hosts format. Entries are keyed by the host:port of the
+// multiaddr - "[1.2.3.4]:4001" - so 'ssh-keygen -R "[1.2.3.4]:4001" -f file'
+// removes a pinned key.
+//
+// The first connection to a host pins its key, later connections with a
+// different key fail with HostKeyChangedError.
+type KnownHosts struct {
+	// File is read on each dial, so external edits take effect immediately.
+	File string
+
+	mu sync.Mutex
+}
+
+// HostKeyChangedError is returned when the key of a host doesn't match the
+// pinned key - the host was re-keyed, or someone is intercepting.
+type HostKeyChangedError struct {
+	Host string
+	File string
+	Line int
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("known_hosts: host key for %s changed, pinned at %s:%d - remove with ssh-keygen -R %q -f %s if expected",
+		e.Host, e.File, e.Line, e.Host, e.File)
+}
+
+// NewKnownHosts returns a store using the file, creating it if needed.
+func NewKnownHosts(file string) (*KnownHosts, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &KnownHosts{File: file}, nil
+}
+
+// check verifies the key of hostport, pinning it if the host is unknown.
+func (kh *KnownHosts) check(hostport string, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if _, self := cert.Extensions[identityExtension]; self {
+			return errors.New("known_hosts: can't pin ephemeral identity key")
+		}
+		// Pin the key, certificates are renewed.
+		key = cert.Key
+	}
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	cb, err := knownhosts.New(kh.File)
+	if err != nil {
+		return err
+	}
+	err = cb(hostport, hostPortAddr(hostport), key)
+	if err == nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		e := &HostKeyChangedError{
+			Host: knownhosts.Normalize(hostport),
+			File: keyErr.Want[0].Filename,
+			Line: keyErr.Want[0].Line,
+		}
+		log.Println(e)
+		return e
+	}
+
+	f, err := os.OpenFile(kh.File, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostport)}, key) + "\n")
+	return err
+}
+
+// hostPortAddr is a net.Addr for the known_hosts callback, which expects
+// String() to return host:port.
+type hostPortAddr string
+
+func (a hostPortAddr) Network() string {
+	return "tcp"
+}
+
+func (a hostPortAddr) String() string {
+	return string(a)
+}
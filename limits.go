@@ -0,0 +1,177 @@
+package wstransport
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Protection of the listener against unauthenticated peers.
+
+// DefaultHandshakeTimeout is used if SSHTransport.HandshakeTimeout is not set.
+var DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxPendingHandshakes is used if SSHTransport.MaxPendingHandshakes is
+// not set.
+var DefaultMaxPendingHandshakes = 128
+
+// DefaultHandshakeWorkers is used if SSHTransport.HandshakeWorkers is not set.
+var DefaultHandshakeWorkers = 16
+
+// DefaultAcceptBacklog is used if SSHTransport.AcceptBacklog is not set.
+var DefaultAcceptBacklog = 16
+
+// Reasons for dropping inbound connections, counted in DropStats.
+const (
+	DropRateLimited      = "rate-limited"
+	DropTooManyPending   = "too-many-pending"
+	DropHandshakeTimeout = "handshake-timeout"
+	DropHandshakeFailed  = "handshake-failed"
+	DropGated            = "gated"
+	DropForbidden        = "forbidden"
+)
+
+// DropStats returns the number of inbound connections dropped before
+// completing the handshake, by reason.
+func (t *SSHTransport) DropStats() map[string]uint64 {
+	t.dropMu.Lock()
+	defer t.dropMu.Unlock()
+	res := map[string]uint64{}
+	for k, v := range t.drops {
+		res[k] = v
+	}
+	return res
+}
+
+func (t *SSHTransport) countDrop(reason string) {
+	t.dropMu.Lock()
+	defer t.dropMu.Unlock()
+	if t.drops == nil {
+		t.drops = map[string]uint64{}
+	}
+	t.drops[reason]++
+}
+
+// handshakeFailed counts and reports a failed inbound handshake.
+func (t *SSHTransport) handshakeFailed(remote net.Addr, err error) {
+	t.countHandshakeError(err)
+	if t.OnHandshakeError != nil {
+		t.OnHandshakeError(remote, err)
+	}
+}
+
+// countHandshakeError counts a failed inbound handshake.
+func (t *SSHTransport) countHandshakeError(err error) {
+	var ne net.Error
+	switch {
+	case errors.Is(err, errGated):
+		t.countDrop(DropGated)
+	case errors.As(err, &ne) && ne.Timeout():
+		t.countDrop(DropHandshakeTimeout)
+	default:
+		t.countDrop(DropHandshakeFailed)
+	}
+}
+
+func (t *SSHTransport) handshakeTimeout() time.Duration {
+	if t.HandshakeTimeout > 0 {
+		return t.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (t *SSHTransport) handshakeWorkers() int {
+	if t.HandshakeWorkers > 0 {
+		return t.HandshakeWorkers
+	}
+	return DefaultHandshakeWorkers
+}
+
+func (t *SSHTransport) acceptBacklog() int {
+	if t.AcceptBacklog > 0 {
+		return t.AcceptBacklog
+	}
+	return DefaultAcceptBacklog
+}
+
+func (t *SSHTransport) maxPendingHandshakes() int {
+	if t.MaxPendingHandshakes > 0 {
+		return t.MaxPendingHandshakes
+	}
+	return DefaultMaxPendingHandshakes
+}
+
+// rateLimiter is a token bucket per source IP.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds the memory used by the limiter. When reached, full
+// buckets are removed, then the least recently used ones - their IPs get a
+// full burst again.
+const maxBuckets = 10000
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for the IP, if available.
+func (r *rateLimiter) allow(ip string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[ip]
+	if !ok {
+		if len(r.buckets) >= maxBuckets {
+			r.gc(now)
+		}
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (r *rateLimiter) gc(now time.Time) {
+	for ip, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, ip)
+		}
+	}
+	if len(r.buckets) < maxBuckets {
+		return
+	}
+	// Many new IPs within a refill period. Evict a tenth, so the sort runs
+	// once per maxBuckets/10 new IPs.
+	ips := make([]string, 0, len(r.buckets))
+	for ip := range r.buckets {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return r.buckets[ips[i]].last.Before(r.buckets[ips[j]].last)
+	})
+	for _, ip := range ips[:len(ips)-maxBuckets*9/10] {
+		delete(r.buckets, ip)
+	}
+}
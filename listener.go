@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	ws "github.com/gorilla/websocket"
 	"github.com/libp2p/go-libp2p-core/transport"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -15,12 +18,44 @@ type listener struct {
 	addr  net.Addr
 	laddr ma.Multiaddr
 
-	closed   chan struct{}
-	incoming chan *Conn
-	t        *SSHTransport
+	closed    chan struct{}
+	closeOnce sync.Once
+	t         *SSHTransport
+
+	// incoming holds admitted raw connections for the handshake workers,
+	// ready the authenticated ones for Accept. mu orders enqueue and Close.
+	mu       sync.Mutex
+	incoming chan net.Conn
+	ready    chan transport.CapableConn
+
+	upgrader ws.Upgrader
+
+	// pending holds a slot for each connection not yet authenticated.
+	pending chan struct{}
+	limiter *rateLimiter
+
+	// Raw connections in handshake, and the accepted connections.
+	inflight inflight
+	conns    connSet
+
+	// mountPath is the Mux path of a mounted listener.
+	mountPath string
 }
 
+// Close stops accepting connections. The Mux path of a mounted listener
+// rejects requests until a new listener is mounted there.
 func (l *listener) Close() error {
+	l.mu.Lock()
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	l.mu.Unlock()
+	l.inflight.closeAll()
+	l.drain()
+	l.t.removeListener(l)
+	if l.mountPath != "" {
+		l.t.unmount(l)
+	}
 	if l.l != nil {
 		return l.l.Close()
 	}
@@ -32,40 +67,161 @@ func (l *listener) Addr() net.Addr {
 }
 
 func (l *listener) serve() {
-	if l.l == nil {
-		return
+	defer l.Close()
+	hs := &http.Server{
+		Handler: l,
+		// No ReadTimeout/WriteTimeout - the deadlines stay on hijacked
+		// connections. The SSH handshake has its own timeout.
+		ReadHeaderTimeout: l.t.handshakeTimeout(),
+		IdleTimeout:       l.t.handshakeTimeout(),
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
-	defer close(l.closed)
-	_ = http.Serve(l.l, l)
+	_ = hs.Serve(l.l)
 }
 
+// maxHeaderBytes limits the upgrade request headers.
+const maxHeaderBytes = 16 * 1024
+
 func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	select {
+	case <-l.closed:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if l.limiter != nil && !l.limiter.allow(dialHost(r.RemoteAddr), time.Now()) {
+		l.t.countDrop(DropRateLimited)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	if !l.t.checkHost(r) {
+		l.t.countDrop(DropForbidden)
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	if !l.t.checkOrigin(r) {
+		l.t.countDrop(DropForbidden)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if l.t.Gater != nil {
+		addrs, err := l.requestAddrs(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !l.t.Gater.InterceptAccept(addrs) {
+			l.t.countDrop(DropGated)
+			http.Error(w, errGated.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	select {
+	case l.pending <- struct{}{}:
+	default:
+		l.t.countDrop(DropTooManyPending)
+		http.Error(w, "too many pending handshakes", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := l.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		// The upgrader writes a response for us.
+		<-l.pending
 		return
 	}
 
+	l.enqueue(NewConn(c))
+	// The connection has been hijacked, it's safe to return.
+}
+
+// enqueue passes an admitted connection, holding a pending slot, to the
+// handshake workers.
+func (l *listener) enqueue(nc net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	select {
-	case l.incoming <- NewConn(c):
 	case <-l.closed:
-		c.Close()
+		<-l.pending
+		nc.Close()
+	default:
+		// Doesn't block - the capacity is the number of pending slots.
+		l.incoming <- nc
 	}
-	// The connection has been hijacked, it's safe to return.
 }
 
+// handshakeWorker authenticates connections until the listener is closed.
+func (l *listener) handshakeWorker() {
+	for {
+		select {
+		case nc := <-l.incoming:
+			cc, err := l.handshake(nc)
+			<-l.pending
+			if err != nil {
+				l.t.handshakeFailed(nc.RemoteAddr(), err)
+				continue
+			}
+			trackConn(&l.conns, cc)
+			select {
+			case l.ready <- cc:
+				// Both cases may be ready when closing - drain again in
+				// case Close already did.
+				if isClosed(l.closed) {
+					l.drain()
+				}
+			case <-l.closed:
+				cc.Close()
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *listener) handshake(nc net.Conn) (transport.CapableConn, error) {
+	if !l.inflight.add(nc) {
+		closeWithReason(nc, "listener closed")
+		return nil, errClosed
+	}
+	defer l.inflight.remove(nc)
+	if wc, ok := nc.(*Conn); ok && wc.Subprotocol() != PROTO_SSH {
+		// Stock libp2p ws dialer.
+		return l.t.upgradeLibp2p(nc, nil, "")
+	}
+	return l.t.NewCapableConn(nc, true)
+}
+
+// drain closes the connections queued when the listener is closed.
+func (l *listener) drain() {
+	for {
+		select {
+		case nc := <-l.incoming:
+			<-l.pending
+			nc.Close()
+		case cc := <-l.ready:
+			cc.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Accept returns the next authenticated connection. Handshakes run in the
+// background, failures are reported to OnHandshakeError - an error would
+// stop the accept loop.
 func (l *listener) Accept() (transport.CapableConn, error) {
 	select {
-	case c, ok := <-l.incoming:
-		if !ok {
-			return nil, fmt.Errorf("listener is closed")
-		}
-		return l.t.NewCapableConn(c, true)
+	case cc := <-l.ready:
+		return cc, nil
 	case <-l.closed:
 		return nil, fmt.Errorf("listener is closed")
 	}
 }
 
+// Multiaddr returns the bound address, with the port resolved. Unspecified
+// addresses are kept, for the swarm to expand - Multiaddrs returns the
+// interface addresses.
 func (l *listener) Multiaddr() ma.Multiaddr {
 	return l.laddr
 }
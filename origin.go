@@ -0,0 +1,66 @@
+package wstransport
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browser access policy for the listener. Browsers always send an Origin
+// header with WebSocket requests, so by default only non-browser clients are
+// accepted - any web page could otherwise connect to a node on localhost.
+
+// checkOrigin implements the websocket upgrader CheckOrigin.
+func (t *SSHTransport) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, p := range t.AllowedOrigins {
+		if p == "*" {
+			return true
+		}
+		pu, err := url.Parse(p)
+		if err != nil || !strings.EqualFold(pu.Scheme, u.Scheme) {
+			continue
+		}
+		if matchHost(pu.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost verifies the Host header, to block DNS rebinding.
+func (t *SSHTransport) checkHost(r *http.Request) bool {
+	if len(t.AllowedHosts) == 0 {
+		return true
+	}
+	for _, p := range t.AllowedHosts {
+		host := r.Host
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			// No port in the pattern - any port.
+			host = dialHost(r.Host)
+		}
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost matches a host against a pattern that is either exact or
+// starts with "*." to match any subdomain.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
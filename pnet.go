@@ -0,0 +1,180 @@
+package wstransport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// Private network support, similar to go-libp2p-pnet: the raw connection is
+// encrypted with XSalsa20 keyed by the PSK, and SSH runs on top.
+//
+// Unlike pnet, each side also sends a known magic encrypted with the PSK, so a
+// mismatch is detected before the SSH handshake instead of surfacing as a
+// garbled version string.
+
+// ErrPSKMismatch is returned when the remote side doesn't use the same
+// private network key.
+var ErrPSKMismatch = errors.New("pnet: remote does not share the private network key")
+
+var pskMagic = []byte("/ssh/pnet/1.0.0\n")
+
+// pskMismatchLine is sent in clear to a remote without PSK. The ssh package
+// skips lines before the version, and the remote finds it in what it read.
+var pskMismatchLine = []byte("\r\n" + ErrPSKMismatch.Error() + "\r\n")
+
+const pskNonceSize = 24
+
+// pskConn encrypts all data on the wrapped connection.
+type pskConn struct {
+	net.Conn
+
+	r *xsalsa20
+
+	writeLock sync.Mutex
+	w         *xsalsa20
+}
+
+// newPSKConn exchanges nonces and the PSK proof with the remote side. The
+// caller sets the handshake deadline.
+func newPSKConn(nc net.Conn, psk pnet.PSK) (*pskConn, error) {
+	if len(psk) != 32 {
+		nc.Close()
+		return nil, errors.New("pnet: expected 32 byte PSK")
+	}
+	var key [32]byte
+	copy(key[:], psk)
+
+	out := make([]byte, pskNonceSize+len(pskMagic))
+	if _, err := rand.Read(out[:pskNonceSize]); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c := &pskConn{
+		Conn: nc,
+		w:    newXSalsa20(&key, out[:pskNonceSize]),
+	}
+	c.w.XORKeyStream(out[pskNonceSize:], pskMagic)
+
+	// Both sides write first - don't depend on buffering in the transport.
+	werr := make(chan error, 1)
+	go func() {
+		_, err := nc.Write(out)
+		werr <- err
+	}()
+
+	in := make([]byte, pskNonceSize+len(pskMagic))
+	if _, err := io.ReadFull(nc, in[:4]); err != nil {
+		nc.Close()
+		return nil, pskReadError(err)
+	}
+	if bytes.Equal(in[:4], []byte("SSH-")) {
+		// Plain SSH - the remote doesn't have a PSK configured. Tell it in
+		// band, plain TCP has no close reason.
+		if err := <-werr; err == nil {
+			nc.Write(pskMismatchLine)
+		}
+		closeWithReason(nc, ErrPSKMismatch.Error())
+		return nil, ErrPSKMismatch
+	}
+	if _, err := io.ReadFull(nc, in[4:]); err != nil {
+		nc.Close()
+		return nil, pskReadError(err)
+	}
+
+	c.r = newXSalsa20(&key, in[:pskNonceSize])
+	c.r.XORKeyStream(in[pskNonceSize:], in[pskNonceSize:])
+	if !bytes.Equal(in[pskNonceSize:], pskMagic) {
+		closeWithReason(nc, ErrPSKMismatch.Error())
+		return nil, ErrPSKMismatch
+	}
+	if err := <-werr; err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pskReadError keeps timeouts distinguishable, other errors are likely a
+// remote closing on mismatch.
+func pskReadError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	}
+	return ErrPSKMismatch
+}
+
+// pskError returns ErrPSKMismatch for handshake errors caused by a remote
+// with a PSK closing the connection, when this side has none.
+func (t *SSHTransport) pskError(k *kexSniffer, err error) error {
+	if len(t.Psk) == 0 && k.received(pskMismatchLine) {
+		return ErrPSKMismatch
+	}
+	return err
+}
+
+func (c *pskConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.r.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *pskConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	out := make([]byte, len(b))
+	c.w.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// xsalsa20 is a streaming XSalsa20 cipher - the salsa20 package only handles
+// complete messages.
+type xsalsa20 struct {
+	key     [32]byte
+	counter [16]byte
+	block   [64]byte
+	used    int
+}
+
+func newXSalsa20(key *[32]byte, nonce []byte) *xsalsa20 {
+	x := &xsalsa20{used: 64}
+	var hNonce [16]byte
+	copy(hNonce[:], nonce[:16])
+	salsa.HSalsa20(&x.key, &hNonce, key, &salsa.Sigma)
+	copy(x.counter[:8], nonce[16:])
+	return x
+}
+
+func (x *xsalsa20) XORKeyStream(dst, src []byte) {
+	for len(src) > 0 {
+		if x.used == len(x.block) {
+			x.block = [64]byte{}
+			salsa.XORKeyStream(x.block[:], x.block[:], &x.counter, &x.key)
+			// Little endian block counter in the last 8 bytes.
+			for i := 8; i < 16; i++ {
+				x.counter[i]++
+				if x.counter[i] != 0 {
+					break
+				}
+			}
+			x.used = 0
+		}
+		n := len(x.block) - x.used
+		if n > len(src) {
+			n = len(src)
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ x.block[x.used+i]
+		}
+		x.used += n
+		dst = dst[n:]
+		src = src[n:]
+	}
+}
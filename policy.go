@@ -0,0 +1,330 @@
+package wstransport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CryptoPolicy selects the SSH algorithms used by the transport, in
+// preference order. Use one of the presets, or a modified copy.
+type CryptoPolicy struct {
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+
+	// HostKeyAlgorithms are accepted from servers. The node key is only
+	// offered as host key if its type is listed.
+	HostKeyAlgorithms []string
+
+	// PublicKeyAlgorithms are accepted for client authentication, and used
+	// when authenticating to servers.
+	PublicKeyAlgorithms []string
+}
+
+// ModernCryptoPolicy uses only AEAD ciphers, ECDH key exchange and
+// Ed25519/ECDSA keys. It is the default.
+func ModernCryptoPolicy() *CryptoPolicy {
+	keys := []string{
+		ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	}
+	return &CryptoPolicy{
+		KeyExchanges: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes128-gcm@openssh.com",
+		},
+		// Not used with AEAD ciphers, but must be negotiated.
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com",
+		},
+		HostKeyAlgorithms:   keys,
+		PublicKeyAlgorithms: keys,
+	}
+}
+
+// CompatibleCryptoPolicy adds CTR ciphers, SHA1 based key exchange and MAC
+// and RSA keys, for interop with older SSH implementations.
+func CompatibleCryptoPolicy() *CryptoPolicy {
+	p := ModernCryptoPolicy()
+	p.KeyExchanges = append(p.KeyExchanges, "diffie-hellman-group14-sha1")
+	p.Ciphers = append(p.Ciphers, "aes128-ctr", "aes192-ctr", "aes256-ctr")
+	p.MACs = append(p.MACs, "hmac-sha2-256", "hmac-sha1")
+	p.HostKeyAlgorithms = append(p.HostKeyAlgorithms, ssh.CertAlgoRSAv01, ssh.KeyAlgoRSA)
+	p.PublicKeyAlgorithms = append(p.PublicKeyAlgorithms, ssh.CertAlgoRSAv01, ssh.KeyAlgoRSA)
+	return p
+}
+
+// FIPSCryptoPolicy restricts the algorithms to FIPS 140 approved ones -
+// NIST curves, AES and SHA2. Nodes need ECDSA keys.
+func FIPSCryptoPolicy() *CryptoPolicy {
+	keys := []string{
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	}
+	return &CryptoPolicy{
+		KeyExchanges: []string{
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		},
+		Ciphers: []string{
+			"aes128-gcm@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+		},
+		HostKeyAlgorithms:   keys,
+		PublicKeyAlgorithms: keys,
+	}
+}
+
+// CryptoPolicyByName returns a preset - "modern", "compatible" or "fips".
+func CryptoPolicyByName(name string) (*CryptoPolicy, error) {
+	switch strings.ToLower(name) {
+	case "modern", "":
+		return ModernCryptoPolicy(), nil
+	case "compatible":
+		return CompatibleCryptoPolicy(), nil
+	case "fips":
+		return FIPSCryptoPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown crypto policy %q", name)
+}
+
+func (p *CryptoPolicy) config() ssh.Config {
+	return ssh.Config{
+		KeyExchanges: p.KeyExchanges,
+		Ciphers:      p.Ciphers,
+		MACs:         p.MACs,
+	}
+}
+
+// allowedSigners returns the signers with a key type in the allowed list.
+func allowedSigners(allowed []string, signers ...ssh.Signer) []ssh.Signer {
+	res := []ssh.Signer{}
+	for _, s := range signers {
+		if s != nil && contains(allowed, s.PublicKey().Type()) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (t *SSHTransport) cryptoPolicy() *CryptoPolicy {
+	if t.CryptoPolicy != nil {
+		return t.CryptoPolicy
+	}
+	return defaultCryptoPolicy
+}
+
+var defaultCryptoPolicy = ModernCryptoPolicy()
+
+var errPolicyKey = errors.New("node key type not allowed by the crypto policy")
+
+// SetCryptoPolicy sets the crypto policy, failing if the node key can't be
+// used with it.
+func (t *SSHTransport) SetCryptoPolicy(p *CryptoPolicy) error {
+	if err := checkNodeKey(p, t.signer); err != nil {
+		return err
+	}
+	t.CryptoPolicy = p
+	return nil
+}
+
+// checkNodeKey fails if the policy doesn't allow the node key, which would
+// fail every handshake. RSA keys need CompatibleCryptoPolicy.
+func checkNodeKey(p *CryptoPolicy, signer ssh.Signer) error {
+	if signer == nil {
+		return nil
+	}
+	kt := signer.PublicKey().Type()
+	if !contains(p.HostKeyAlgorithms, kt) || !contains(p.PublicKeyAlgorithms, kt) {
+		hint := ""
+		if kt == ssh.KeyAlgoRSA {
+			hint = ", use CompatibleCryptoPolicy"
+		}
+		return fmt.Errorf("%w: %s%s", errPolicyKey, kt, hint)
+	}
+	return nil
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Algorithms are the algorithms negotiated on a connection.
+type Algorithms struct {
+	KeyExchange string
+	HostKey     string
+
+	// Write and Read are the algorithms for each direction, from the local
+	// side. The MAC is not used with AEAD ciphers.
+	Write DirectionAlgorithms
+	Read  DirectionAlgorithms
+}
+
+type DirectionAlgorithms struct {
+	Cipher string
+	MAC    string
+}
+
+// kexSniffer records the KEXINIT messages exchanged in the first key exchange.
+// The ssh package doesn't expose the negotiated algorithms - they are computed
+// the same way, from both sides' preferences.
+type kexSniffer struct {
+	net.Conn
+	isClient bool
+
+	mu      sync.Mutex
+	done    bool
+	in, out []byte
+	algs    *Algorithms
+}
+
+// maxKexInitPrefix bounds the data buffered looking for KEXINIT.
+const maxKexInitPrefix = 64 * 1024
+
+func (k *kexSniffer) Read(b []byte) (int, error) {
+	n, err := k.Conn.Read(b)
+	k.record(&k.in, b[:n])
+	return n, err
+}
+
+func (k *kexSniffer) Write(b []byte) (int, error) {
+	k.record(&k.out, b)
+	return k.Conn.Write(b)
+}
+
+func (k *kexSniffer) record(buf *[]byte, b []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.done {
+		return
+	}
+	*buf = append(*buf, b...)
+	if len(*buf) > maxKexInitPrefix {
+		k.done = true
+		return
+	}
+	local, lok := parseKexInit(k.out)
+	remote, rok := parseKexInit(k.in)
+	if !lok || !rok {
+		return
+	}
+	k.done = true
+	k.in, k.out = nil, nil
+	k.algs = negotiate(local, remote, k.isClient)
+}
+
+// received returns true if b was read before the key exchange completed.
+func (k *kexSniffer) received(b []byte) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return bytes.Contains(k.in, b)
+}
+
+func (k *kexSniffer) algorithms() Algorithms {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.algs == nil {
+		return Algorithms{}
+	}
+	return *k.algs
+}
+
+// Name lists in KEXINIT, RFC 4253 section 7.1.
+const (
+	kexAlgos = iota
+	kexHostKeyAlgos
+	kexCiphersClientServer
+	kexCiphersServerClient
+	kexMACsClientServer
+	kexMACsServerClient
+	kexNameLists
+)
+
+// parseKexInit extracts the name lists from the first packet following the
+// version line.
+func parseKexInit(b []byte) ([][]string, bool) {
+	// Version exchange - lines before the SSH- line are allowed.
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return nil, false
+		}
+		line := b[:i]
+		b = b[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+	if len(b) < 5 {
+		return nil, false
+	}
+	plen := binary.BigEndian.Uint32(b)
+	if plen < 1 || uint32(len(b)-4) < plen {
+		return nil, false
+	}
+	payload := b[5 : 4+plen]
+	// msgKexInit, cookie
+	if len(payload) < 17 || payload[0] != 20 {
+		return nil, false
+	}
+	payload = payload[17:]
+	lists := make([][]string, kexNameLists)
+	for i := range lists {
+		if len(payload) < 4 {
+			return nil, false
+		}
+		l := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < l {
+			return nil, false
+		}
+		lists[i] = strings.Split(string(payload[4:4+l]), ",")
+		payload = payload[4+l:]
+	}
+	return lists, true
+}
+
+// negotiate picks the first client algorithm supported by the server.
+func negotiate(local, remote [][]string, isClient bool) *Algorithms {
+	client, server := local, remote
+	if !isClient {
+		client, server = remote, local
+	}
+	pick := func(i int) string {
+		for _, c := range client[i] {
+			if contains(server[i], c) {
+				return c
+			}
+		}
+		return ""
+	}
+	cs := DirectionAlgorithms{Cipher: pick(kexCiphersClientServer), MAC: pick(kexMACsClientServer)}
+	sc := DirectionAlgorithms{Cipher: pick(kexCiphersServerClient), MAC: pick(kexMACsServerClient)}
+	a := &Algorithms{
+		KeyExchange: pick(kexAlgos),
+		HostKey:     pick(kexHostKeyAlgos),
+		Write:       cs,
+		Read:        sc,
+	}
+	if !isClient {
+		a.Write, a.Read = sc, cs
+	}
+	return a
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package wstransport
+
+func init() {
+	raceEnabled = true
+}
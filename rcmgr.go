@@ -0,0 +1,153 @@
+package wstransport
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Resource accounting. The libp2p version used here has no resource manager,
+// ResourceManager has the same shape as the subset of network.ResourceManager
+// used by transports, so an adapter is trivial.
+//
+// Each connection has a scope, with the peer set after the handshake. Each
+// SSH stream has a scope, with memory reserved for the channel window - the
+// data the remote may send before it is read - and the read and write
+// buffers. Streams of fallback connections are muxed by yamux or mplex and
+// are not accounted.
+
+// ResourceManager reserves resources for connections and streams.
+type ResourceManager interface {
+	// OpenConnection is called before the handshake, endpoint is the remote
+	// address.
+	OpenConnection(dir network.Direction, usefd bool, endpoint ma.Multiaddr) (ConnManagementScope, error)
+
+	// OpenStream is called before opening or accepting a stream.
+	OpenStream(p peer.ID, dir network.Direction) (StreamManagementScope, error)
+}
+
+// ResourceScope is a scope memory can be reserved in.
+type ResourceScope interface {
+	ReserveMemory(size int, prio uint8) error
+	ReleaseMemory(size int)
+}
+
+// ConnManagementScope is the scope of a connection.
+type ConnManagementScope interface {
+	ResourceScope
+	SetPeer(p peer.ID) error
+	Done()
+}
+
+// StreamManagementScope is the scope of a stream.
+type StreamManagementScope interface {
+	ResourceScope
+	SetProtocol(p protocol.ID) error
+	Done()
+}
+
+const (
+	// Window of SSH channels, as set by the ssh package.
+	channelWindow = 64 * 32 * 1024
+
+	// streamMemory is reserved for each stream.
+	streamMemory = channelWindow + 2*streamChunk
+
+	// connMemory is reserved for each connection, for the SSH packet
+	// buffers.
+	connMemory = 2 * 256 * 1024
+
+	// Priority of the reservations - the memory is needed to use the
+	// connection or stream at all.
+	reservePriority uint8 = 204
+)
+
+// RejectResourceLimit is the reason counted in StreamRejectStats for streams
+// refused by the ResourceManager.
+const RejectResourceLimit = "resource-limit"
+
+// openConnScope opens the scope of a new connection and reserves its memory.
+// Nil if there is no ResourceManager.
+func (t *SSHTransport) openConnScope(dir network.Direction, raddr ma.Multiaddr) (ConnManagementScope, error) {
+	if t.ResourceManager == nil {
+		return nil, nil
+	}
+	scope, err := t.ResourceManager.OpenConnection(dir, true, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := scope.ReserveMemory(connMemory, reservePriority); err != nil {
+		scope.Done()
+		return nil, err
+	}
+	return scope, nil
+}
+
+// setScopePeer sets the peer of a connection scope, if any.
+func setScopePeer(scope ConnManagementScope, p peer.ID) error {
+	if scope == nil {
+		return nil
+	}
+	return scope.SetPeer(p)
+}
+
+// releaseConnScope releases the memory and closes the scope, if any.
+func releaseConnScope(scope ConnManagementScope) {
+	if scope == nil {
+		return
+	}
+	scope.ReleaseMemory(connMemory)
+	scope.Done()
+}
+
+// openScope opens the scope of a new stream and reserves its memory.
+func (s *stream) openScope() error {
+	rm := s.con.t.ResourceManager
+	if rm == nil {
+		return nil
+	}
+	scope, err := rm.OpenStream(s.con.remoteID, s.stat.Direction)
+	if err != nil {
+		return err
+	}
+	if err := scope.ReserveMemory(streamMemory, reservePriority); err != nil {
+		scope.Done()
+		return err
+	}
+	if s.proto != "" {
+		if err := scope.SetProtocol(s.proto); err != nil {
+			scope.ReleaseMemory(streamMemory)
+			scope.Done()
+			return err
+		}
+	}
+	s.scope = scope
+	return nil
+}
+
+// releaseScope releases the stream memory and scope, once.
+func (s *stream) releaseScope() {
+	s.scopeOnce.Do(func() {
+		if s.scope != nil {
+			s.scope.ReleaseMemory(streamMemory)
+			s.scope.Done()
+		}
+	})
+}
+
+// releaseResources releases the scopes of the connection and its streams.
+func (c *SSHConn) releaseResources() {
+	c.scopeOnce.Do(func() {
+		c.streamsMu.Lock()
+		streams := make([]*stream, 0, len(c.streams))
+		for s := range c.streams {
+			streams = append(streams, s)
+		}
+		c.streamsMu.Unlock()
+		for _, s := range streams {
+			s.releaseScope()
+		}
+		releaseConnScope(c.scope)
+	})
+}
@@ -1,21 +1,22 @@
 package wstransport
 
 import (
-	"crypto/ed25519"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
-	crypto_pb "github.com/libp2p/go-libp2p-core/crypto/pb"
 	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/pnet"
 	"github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -26,46 +27,57 @@ const sshVersion = "SSH-2.0-dmesh"
 
 
 
-func PrivKey2SSH(key ic.PrivKey) (ssh.Signer, error) {
-	keyB, _ := key.Raw()
+// PeerIDMismatchError is returned by Dial when the key presented by the remote
+// host does not derive to the requested peer ID.
+type PeerIDMismatchError struct {
+	Expected peer.ID
+	Actual   peer.ID
+}
 
-	switch key.Type() {
-	case crypto_pb.KeyType_Ed25519:
-		ed := ed25519.PrivateKey(keyB)
-		signer, err := ssh.NewSignerFromKey(ed) // ssh.Signer
-		if err != nil {
-			return nil, err
+func (e *PeerIDMismatchError) Error() string {
+	return fmt.Sprintf("peer id mismatch: expected %s, remote host key is %s", e.Expected, e.Actual)
+}
+
+// errNoPeerID is returned when dialing without a peer ID and AllowAnyPeer
+// doesn't permit it.
+var errNoPeerID = errors.New("dial without peer id not allowed")
+
+// checkHostKey verifies the remote host key against the peer ID we dialed,
+// and returns the remote identity.
+func (t *SSHTransport) checkHostKey(raddr ma.Multiaddr, p peer.ID, key ssh.PublicKey) (peer.ID, ic.PubKey, error) {
+	hostport := ""
+	if raddr != nil {
+		if _, hp, err := manet.DialArgs(raddr); err == nil {
+			hostport = hp
 		}
-		return signer, nil
-	case crypto_pb.KeyType_RSA:
-		// RSA: bytes is the DER form
-		rsa, err := x509.ParsePKCS1PrivateKey(keyB)
-		if err != nil {
-			return nil, err
+	}
+	actual, pk, err := t.hostIdentity(dialHost(hostport), p, key)
+	if err != nil {
+		return "", nil, err
+	}
+	if p == "" {
+		if t.KnownHosts != nil && hostport != "" {
+			if err := t.KnownHosts.check(hostport, key); err != nil {
+				return "", nil, err
+			}
+			return actual, pk, nil
 		}
-			signer, _ := ssh.NewSignerFromKey(rsa)
-			return signer, nil
-
-	case crypto_pb.KeyType_ECDSA:
-		ed, err := x509.ParseECPrivateKey(keyB)
-		if err != nil {
-			return nil, err
+		if t.AllowAnyPeer != nil && t.AllowAnyPeer(raddr) {
+			return actual, pk, nil
 		}
-			signer, _ := ssh.NewSignerFromKey(ed)
-			return signer, nil
-
-	//case crypto_pb.KeyType_Secp256k1:
-		// Not supported
+		return "", nil, errNoPeerID
 	}
-
-	return nil, errors.New("Unsupported")
+	if actual != p {
+		return "", nil, &PeerIDMismatchError{Expected: p, Actual: actual}
+	}
+	return actual, pk, nil
 }
 
 // NewWsSshTransport creates a new transport using Websocket and SSH
 // Based on QUIC transport.
 //
 func NewSSHTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater) (*SSHTransport, error) {
-	signer, err := PrivKey2SSH(key)
+	signer, err := newIdentitySigner(key)
 	if err != nil {
 		return nil, err
 	}
@@ -74,46 +86,7 @@ func NewSSHTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater
 		Key: key, Psk: psk, Gater: gater,
 
 		signer: signer,
-		clientConfig: &ssh.ClientConfig{
-			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
-			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-				return nil
-			},
-			Config: ssh.Config{
-				MACs: []string{
-					"hmac-sha2-256-etm@openssh.com",
-					"hmac-sha2-256",
-					"hmac-sha1",
-					"hmac-sha1-96",
-				},
-				Ciphers: []string{
-					"aes128-gcm@openssh.com",
-					"chacha20-poly1305@openssh.com",
-					"aes128-ctr", "none",
-				},
-			},
-		},
-		serverConfig: &ssh.ServerConfig{
-			PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-				return nil, fmt.Errorf("password rejected for %q", c.User())
-			},
-			ServerVersion: sshVersion,
-			//PublicKeyCallback: sshGate.authPub,
-			Config: ssh.Config{
-				// none is not included
-				MACs: []string{
-					"hmac-sha2-256-etm@openssh.com",
-					"hmac-sha2-256",
-					"hmac-sha1",
-					"hmac-sha1-96",
-				},
-				Ciphers: []string{
-					"aes128-gcm@openssh.com",
-					"chacha20-poly1305@openssh.com",
-					"aes128-ctr", "none",
-				},
-			},
-		},
+		userSigners: []ssh.Signer{signer},
 	}, nil
 }
 
@@ -124,28 +97,106 @@ func (t *SSHTransport) NewConn(nc net.Conn, isServer bool) (mux.MuxedConn, error
 }
 
 // NewConn wraps a net.Conn using SSH for MUX and security.
+// On the client side the remote peer is not known, so the host key is only
+// accepted if AllowAnyPeer permits it.
 func (t *SSHTransport) NewCapableConn(nc net.Conn, isServer bool) (transport.CapableConn, error) {
+	c, err := t.newCapableConn(nc, isServer, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newCapableConn runs the SSH handshake. When dialing, raddr and p identify the
+// expected remote peer.
+func (t *SSHTransport) newCapableConn(nc net.Conn, isServer bool, raddr ma.Multiaddr, p peer.ID) (*SSHConn, error) {
 	c := &SSHConn{
 		closed: make(chan struct{}),
 		t: t,
 		wsCon:  nc,
+		id:     atomic.AddUint64(&connIDs, 1),
 	}
 	c.ConnectTime = time.Now()
+	c.stat = network.Stat{Direction: network.DirOutbound, Opened: c.ConnectTime}
+	if isServer {
+		c.stat.Direction = network.DirInbound
+	}
+	c.laddr, c.raddr = connMultiaddrs(nc)
+	if raddr != nil {
+		c.raddr = raddr
+	}
 
-	c.streamQueue = make(chan ssh.Channel, 10)
+	scope, err := t.openConnScope(c.stat.Direction, c.raddr)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c.scope = scope
+	established := false
+	defer func() {
+		if !established {
+			c.releaseResources()
+		}
+	}()
+
+	// Never blocks, pending streams are limited by admitStream.
+	c.streamQueue = make(chan *stream, t.maxPendingStreams())
+
+	// Bound the handshake - cleared once authenticated.
+	nc.SetDeadline(time.Now().Add(t.handshakeTimeout()))
+
+	if len(t.Psk) > 0 {
+		pc, err := newPSKConn(nc, t.Psk)
+		if err != nil {
+			return nil, err
+		}
+		nc = pc
+	}
+
+	policy := t.cryptoPolicy()
+	c.kex = &kexSniffer{Conn: nc, isClient: !isServer}
+	nc = c.kex
 
 	if isServer {
+		gated := false
 		sc := &ssh.ServerConfig{
-			Config: t.serverConfig.Config,
+			Config: policy.config(),
 			ServerVersion: sshVersion,
+			// The callback may be called for several keys - the identity
+			// of the key that completed auth is kept in the permissions.
 			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				c.remotePub = key
-				return &ssh.Permissions{}, nil
+				if !contains(policy.PublicKeyAlgorithms, key.Type()) {
+					return nil, fmt.Errorf("public key type %s not allowed", key.Type())
+				}
+				pid, _, perms, err := t.userIdentity(conn, key)
+				if err != nil {
+					return nil, err
+				}
+				if t.Gater != nil && !t.Gater.InterceptSecured(network.DirInbound, pid, c) {
+					gated = true
+					closeGated(c.wsCon, "secured", 0)
+					return nil, errGated
+				}
+				return perms, nil
 			},
 		}
-		sc.AddHostKey(t.signer)
+		hostKeys := allowedSigners(policy.HostKeyAlgorithms, t.hostCert, t.signer)
+		if len(hostKeys) == 0 {
+			nc.Close()
+			return nil, errPolicyKey
+		}
+		for _, k := range hostKeys {
+			sc.AddHostKey(k)
+		}
 		conn, chans, globalSrvReqs, err := ssh.NewServerConn(nc, sc)
 		if err != nil {
+			if gated {
+				return nil, errGated
+			}
+			return nil, t.pskError(c.kex, err)
+		}
+		if err := c.setRemoteIdentity(conn.Permissions); err != nil {
+			conn.Close()
 			return nil, err
 		}
 		c.sc =     conn
@@ -153,18 +204,41 @@ func (t *SSHTransport) NewCapableConn(nc net.Conn, isServer bool) (transport.Cap
 		c.req = globalSrvReqs
 		// From handshake
 	} else {
+		userKeys := allowedSigners(policy.PublicKeyAlgorithms, t.userSigners...)
+		if len(userKeys) == 0 {
+			nc.Close()
+			return nil, errPolicyKey
+		}
+		var hostKeyErr error
 		cc, chans, reqs, err := ssh.NewClientConn(nc, "", &ssh.ClientConfig{
-			Auth: t.clientConfig.Auth,
-			Config: t.clientConfig.Config,
+			User: c.LocalPeer().String(),
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(userKeys...)},
+			Config: policy.config(),
+			HostKeyAlgorithms: policy.HostKeyAlgorithms,
 			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 				c.remotePub = key
-				return nil
+				c.remoteID, c.remoteKey, hostKeyErr = t.checkHostKey(raddr, p, key)
+				if hostKeyErr == nil && t.Gater != nil &&
+					!t.Gater.InterceptSecured(network.DirOutbound, c.remoteID, c) {
+					hostKeyErr = errGated
+					closeGated(c.wsCon, "secured", 0)
+				}
+				return hostKeyErr
 			},
 		})
 		if err != nil {
-			return nil, err
+			// The ssh package flattens the callback error, return the typed one.
+			if hostKeyErr != nil {
+				return nil, hostKeyErr
+			}
+			return nil, t.pskError(c.kex, err)
 		}
-		client := ssh.NewClient(cc, chans, reqs)
+		// Global requests from the server are handled below, like on the
+		// server side.
+		noReqs := make(chan *ssh.Request)
+		close(noReqs)
+		client := ssh.NewClient(cc, chans, noReqs)
+		c.req = reqs
 		c.scl = client
 		// The client adds "forwarded-tcpip" and "forwarded-streamlocal" when ListenTCP is called.
 		// This in turns sends "tcpip-forward" command, with IP:port
@@ -176,32 +250,96 @@ func (t *SSHTransport) NewCapableConn(nc net.Conn, isServer bool) (transport.Cap
 
 			}
 		}()
-		c.inChans = chans
+		// The client reads chans - streams opened by the server are
+		// registered with it.
+		c.inChans = mergeChannels(client.HandleChannelOpen("direct-tcpip"),
+			client.HandleChannelOpen(streamChannelType))
+	}
+
+	c.wsCon.SetDeadline(time.Time{})
+
+	if err := setScopePeer(c.scope, c.remoteID); err != nil {
+		c.Close()
+		return nil, err
 	}
 
 	// At this point we have remotePub
 	// It can be a *ssh.Certificate or ssh.CryptoPublicKey
 	//
 
+	if t.Gater != nil {
+		if allow, reason := t.Gater.InterceptUpgraded(c); !allow {
+			closeGated(c.wsCon, "upgraded", reason)
+			c.Close()
+			return nil, errGated
+		}
+	}
+
 	go func() {
 		for sshc := range c.inChans {
 			switch sshc.ChannelType() {
-			case "direct-tcpip":
-				// Ignore 'ExtraData' containing Raddr, Rport, Laddr, Lport
-				acc, r, _ := sshc.Accept()
-				// Ignore in-band meta
-				go ssh.DiscardRequests(r)
-				c.streamQueue <- acc
+			case "direct-tcpip", streamChannelType:
+				p, headers, rej := c.checkStream(sshc)
+				if rej != nil {
+					sshc.Reject(rej.Reason, rej.Message)
+					continue
+				}
+				s := newStream(c, network.DirInbound)
+				s.proto, s.headers = p, headers
+				if reason := t.admitStream(c, s); reason != "" {
+					sshc.Reject(ssh.ResourceShortage, reason)
+					continue
+				}
+				if err := s.openScope(); err != nil {
+					t.inboundStreamDone(s)
+					t.countStreamReject(RejectResourceLimit)
+					sshc.Reject(ssh.ResourceShortage, RejectResourceLimit)
+					continue
+				}
+				if !c.addStream(s) {
+					t.inboundStreamDone(s)
+					s.releaseScope()
+					sshc.Reject(ssh.Prohibited, errDraining.Error())
+					continue
+				}
+				acc, r, err := sshc.Accept()
+				if err != nil {
+					s.done()
+					continue
+				}
+				t.streamQueued(s)
+				s.attach(acc, r)
+				select {
+				case c.streamQueue <- s:
+				case <-c.closed:
+					s.Close()
+				}
+			default:
+				sshc.Reject(ssh.UnknownChannelType, "unsupported channel type "+sshc.ChannelType())
 			}
 		}
+		// The SSH connection is gone, closed here or by the remote - close
+		// the rest so AcceptStream and IsClosed see it.
+		c.Close()
 	}()
 
+	established = true
+	c.trackIn(&t.conns, c)
+
 	// Handle global requests - keepalive.
 	// This does not support "-R" - use high level protocol
+	// The client handles its own global requests.
+	if c.req == nil {
+		return c, nil
+	}
 	go func() {
 		for r := range c.req {
 				// Global types.
 			switch r.Type {
+				case goAwayRequest:
+					// The remote is closing - stop opening streams.
+					c.startDrain()
+
 				case "keepalive@openssh.com":
 					c.LastSeen = time.Now()
 					//log.Println("SSHD: client keepalive", n.VIP)
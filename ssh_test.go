@@ -1,18 +1,45 @@
 package wstransport
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	ws "github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p-core/control"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	muxtest "github.com/libp2p/go-libp2p-testing/suites/mux"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
+	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/ssh"
 )
 
 const skey = "CAESQDXW7-QhEhXWdgDUg7AvhlJU2eN-2IzMoDOWl_P271npGnwf4KUMcqufSakCfFi373F8C2HqINHxWalQwk3pVrc="
@@ -161,3 +188,1694 @@ func handleConn(conn tpt.CapableConn) error {
 	}
 	return str.Close()
 }
+
+func TestCheckHostKey(t *testing.T) {
+	kb, _ := base64.URLEncoding.DecodeString(skey)
+	priv, _ := ic.UnmarshalPrivateKey(kb)
+	signer, err := PrivKey2SSH(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := signer.PublicKey()
+
+	cpriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	ct, err := NewSSHTransport(cpriv, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := ma.StringCast("/ip4/127.0.0.1/tcp/5555/ws")
+
+	expected, _ := peer.Decode(spub)
+	if _, _, err := ct.checkHostKey(raddr, expected, hostKey); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := peer.IDFromPrivateKey(cpriv)
+	_, _, err = ct.checkHostKey(raddr, other, hostKey)
+	if e, ok := err.(*PeerIDMismatchError); !ok || e.Actual != expected {
+		t.Fatal("expected peer id mismatch, got", err)
+	}
+
+	if _, _, err := ct.checkHostKey(raddr, "", hostKey); err == nil {
+		t.Fatal("dial without peer id should fail by default")
+	}
+	ct.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	if _, _, err := ct.checkHostKey(raddr, "", hostKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPSKConn(t *testing.T) {
+	psk := make([]byte, 32)
+	rand.Read(psk)
+
+	// Stream cipher must match the one-shot XSalsa20.
+	var key [32]byte
+	copy(key[:], psk)
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+	msg := make([]byte, 1000)
+	rand.Read(msg)
+	expected := make([]byte, len(msg))
+	salsa20.XORKeyStream(expected, msg, nonce, &key)
+	x := newXSalsa20(&key, nonce)
+	got := make([]byte, len(msg))
+	for i := 0; i < len(msg); i += 7 {
+		end := i + 7
+		if end > len(msg) {
+			end = len(msg)
+		}
+		x.XORKeyStream(got[i:end], msg[i:end])
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("xsalsa20 stream mismatch")
+	}
+
+	pskPair := func(k1, k2 []byte) (error, error) {
+		c1, c2 := net.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			pc, err := newPSKConn(c2, k2)
+			if err == nil {
+				_, err = io.Copy(pc, pc)
+			}
+			errs <- err
+		}()
+		pc, err := newPSKConn(c1, k1)
+		if err == nil {
+			pc.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(pc, buf); err == nil && string(buf) != "hello" {
+				err = errors.New("unexpected echo " + string(buf))
+			}
+			pc.Close()
+		}
+		err2 := <-errs
+		return err, err2
+	}
+
+	if err, _ := pskPair(psk, psk); err != nil {
+		t.Fatal(err)
+	}
+	other := make([]byte, 32)
+	rand.Read(other)
+	err1, err2 := pskPair(psk, other)
+	if err1 != ErrPSKMismatch || err2 != ErrPSKMismatch {
+		t.Fatal("expected PSK mismatch", err1, err2)
+	}
+}
+
+// One side with a PSK, the other without: both must fail with the mismatch,
+// not an SSH version error.
+func TestPSKMismatch(t *testing.T) {
+	psk := make([]byte, 32)
+	rand.Read(psk)
+
+	run := func(laddr string, spsk, cpsk []byte) (error, error) {
+		priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+		st, _ := NewSSHTransport(priv, spsk, nil)
+		sid, _ := peer.IDFromPrivateKey(priv)
+		herr := make(chan error, 1)
+		st.OnHandshakeError = func(remote net.Addr, err error) {
+			herr <- err
+		}
+		cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+		ct, _ := NewSSHTransport(cpriv, cpsk, nil)
+
+		l, err := st.Listen(ma.StringCast(laddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := ct.Dial(ctx, l.Multiaddr(), sid)
+		if err == nil {
+			c.Close()
+		}
+		select {
+		case serr := <-herr:
+			return err, serr
+		case <-time.After(5 * time.Second):
+			return err, errors.New("no server handshake error")
+		}
+	}
+
+	// Plain TCP has no close reason, the mismatch is reported in band.
+	for _, laddr := range []string{"/ip4/127.0.0.1/tcp/0/wssh", "/ip4/127.0.0.1/tcp/0/ssh"} {
+		cerr, serr := run(laddr, psk, nil)
+		if !errors.Is(cerr, ErrPSKMismatch) || !errors.Is(serr, ErrPSKMismatch) {
+			t.Error(laddr, "server PSK: expected mismatch", cerr, serr)
+		}
+		cerr, serr = run(laddr, nil, psk)
+		if !errors.Is(cerr, ErrPSKMismatch) || !errors.Is(serr, ErrPSKMismatch) {
+			t.Error(laddr, "client PSK: expected mismatch", cerr, serr)
+		}
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kh, err := NewKnownHosts(filepath.Join(dir, "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	ct.KnownHosts = kh
+	raddr := ma.StringCast("/ip4/127.0.0.1/tcp/5555/ws")
+
+	hpriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	hostKey, _ := PrivKey2SSH(hpriv)
+	if _, _, err := ct.checkHostKey(raddr, "", hostKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(kh.File)
+	if !bytes.HasPrefix(data, []byte("[127.0.0.1]:5555 ssh-ed25519 ")) {
+		t.Fatal("unexpected known_hosts", string(data))
+	}
+	if _, _, err := ct.checkHostKey(raddr, "", hostKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	opriv, _, _ := ic.GenerateEd25519Key(rand.Reader)
+	otherKey, _ := PrivKey2SSH(opriv)
+	_, _, err = ct.checkHostKey(raddr, "", otherKey.PublicKey())
+	if _, ok := err.(*HostKeyChangedError); !ok {
+		t.Fatal("expected changed host key", err)
+	}
+}
+
+func TestCryptoPolicy(t *testing.T) {
+	spriv, _, _ := ic.GenerateECDSAKeyPair(rand.Reader)
+	server, _ := NewSSHTransport(spriv, nil, nil)
+	cpriv, _, _ := ic.GenerateECDSAKeyPair(rand.Reader)
+	client, _ := NewSSHTransport(cpriv, nil, nil)
+
+	cc, sc, err := handshake(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algs := cc.Algorithms()
+	if algs.KeyExchange != "curve25519-sha256@libssh.org" ||
+		algs.HostKey != ssh.KeyAlgoECDSA256 ||
+		algs.Write.Cipher != "chacha20-poly1305@openssh.com" {
+		t.Fatal("unexpected algorithms", algs)
+	}
+	if sc.Algorithms().Read != algs.Write || sc.Algorithms().Write != algs.Read {
+		t.Fatal("algorithms don't match", sc.Algorithms(), algs)
+	}
+	cc.Close()
+	sc.Close()
+
+	client.CryptoPolicy = FIPSCryptoPolicy()
+	cc, sc, err = handshake(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algs = sc.Algorithms()
+	if algs.KeyExchange != "ecdh-sha2-nistp256" || algs.Read.Cipher != "aes128-gcm@openssh.com" {
+		t.Fatal("unexpected algorithms", algs)
+	}
+	cc.Close()
+	sc.Close()
+
+	// No common cipher.
+	server.CryptoPolicy = ModernCryptoPolicy()
+	server.CryptoPolicy.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+	if _, _, err := handshake(t, client, server); err == nil {
+		t.Fatal("handshake without common cipher")
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	st := &SSHTransport{}
+	req := func(host, origin string) *http.Request {
+		r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+	if !st.checkOrigin(req("127.0.0.1:5555", "")) {
+		t.Error("non-browser request rejected")
+	}
+	if st.checkOrigin(req("127.0.0.1:5555", "https://evil.example")) {
+		t.Error("browser request accepted by default")
+	}
+
+	st.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	for origin, ok := range map[string]bool{
+		"https://app.example.com":   true,
+		"http://app.example.com":    false,
+		"https://a.b.example.org":   true,
+		"https://example.org":       false,
+		"https://app.example.com.x": false,
+	} {
+		if st.checkOrigin(req("127.0.0.1:5555", origin)) != ok {
+			t.Error("unexpected result for origin", origin)
+		}
+	}
+
+	st.AllowedHosts = []string{"localhost", "*.example.com:443"}
+	for host, ok := range map[string]bool{
+		"localhost:5555":        true,
+		"node.example.com:443":  true,
+		"node.example.com:8080": false,
+		"rebind.evil:5555":      false,
+	} {
+		if st.checkHost(req(host, "")) != ok {
+			t.Error("unexpected result for host", host)
+		}
+	}
+}
+
+func TestHandshakeLimits(t *testing.T) {
+	rl := newRateLimiter(1, 2)
+	now := time.Now()
+	if !rl.allow("1.2.3.4", now) || !rl.allow("1.2.3.4", now) {
+		t.Error("burst rejected")
+	}
+	if rl.allow("1.2.3.4", now) {
+		t.Error("over burst accepted")
+	}
+	if !rl.allow("1.2.3.5", now) {
+		t.Error("other IP rejected")
+	}
+	if !rl.allow("1.2.3.4", now.Add(time.Second)) {
+		t.Error("refill rejected")
+	}
+
+	// New IPs faster than the refill don't grow the map without bound.
+	rl = newRateLimiter(0.001, 1)
+	for i := 0; i < 3*maxBuckets; i++ {
+		rl.allow(fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&255, i&255), now.Add(time.Duration(i)))
+	}
+	if n := len(rl.buckets); n > maxBuckets {
+		t.Error("buckets not bounded", n)
+	}
+	if _, ok := rl.buckets["10.0.0.0"]; ok {
+		t.Error("oldest bucket kept")
+	}
+
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	st.HandshakeTimeout = 100 * time.Millisecond
+
+	// A client that never sends the SSH version.
+	c1, c2 := tcpPipe(t)
+	defer c1.Close()
+	_, err := st.newCapableConn(c2, true, nil, "")
+	if err == nil {
+		t.Fatal("handshake without client succeeded")
+	}
+	st.countHandshakeError(err)
+	if st.DropStats()[DropHandshakeTimeout] != 1 {
+		t.Error("timeout not counted", err, st.DropStats())
+	}
+}
+
+func TestSecureWebSocket(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+
+	if _, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wss")); err == nil {
+		t.Fatal("listening on wss without TLSConfig")
+	}
+
+	cert, pool := testCert(t)
+	st.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	st.ClientTLSConfig = &tls.Config{RootCAs: pool, ServerName: "node.example"}
+
+	for _, suffix := range []string{"/wss", "/tls/ws"} {
+		l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0" + suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		laddr := l.Multiaddr()
+		if !st.CanDial(laddr) || !strings.HasSuffix(laddr.String(), suffix) {
+			t.Error("unexpected listen address", laddr)
+		}
+
+		u, err := parseMultiaddr(laddr)
+		if err != nil || !strings.HasPrefix(u, "wss://") {
+			t.Fatal("unexpected URL", u, err)
+		}
+		d := &ws.Dialer{TLSClientConfig: st.clientTLSConfig(laddr), Subprotocols: []string{PROTO_SSH}}
+		c, _, err := d.Dial(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		l.Close()
+	}
+}
+
+// testCert returns a self-signed certificate for node.example.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"node.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(xc)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCPTransport(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !ct.CanDial(l.Multiaddr()) {
+		t.Fatal("can't dial", l.Multiaddr())
+	}
+
+	sid, _ := peer.IDFromPrivateKey(priv)
+	cid, _ := peer.IDFromPrivateKey(cpriv)
+	ach := make(chan tpt.CapableConn, 1)
+	go func() {
+		sc, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		ach <- sc
+	}()
+	cc, err := ct.Dial(context.Background(), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	sc := <-ach
+	if sc == nil {
+		t.FailNow()
+	}
+	defer sc.Close()
+	if cc.RemotePeer() != sid || sc.RemotePeer() != cid {
+		t.Error("unexpected peers", cc.RemotePeer(), sc.RemotePeer())
+	}
+}
+
+func TestAddrCodec(t *testing.T) {
+	a := ma.StringCast("/ip4/127.0.0.1/tcp/5555/wssh")
+	na, err := manet.ToNetAddr(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if na.Network() != "wssh" || na.(*Addr).Host != "127.0.0.1:5555" {
+		t.Error("unexpected net addr", na)
+	}
+	back, err := manet.FromNetAddr(na)
+	if err != nil || !back.Equal(a) {
+		t.Error("round trip failed", back, err)
+	}
+
+	st := &SSHTransport{}
+	withID := a.Encapsulate(ma.StringCast("/p2p/" + spub))
+	if !st.CanDial(withID) {
+		t.Error("can't dial", withID)
+	}
+	rest, id, err := splitP2P(withID)
+	if err != nil || !rest.Equal(a) || id.String() != spub {
+		t.Error("unexpected split", rest, id, err)
+	}
+
+	// A bare /p2p address has nothing to dial.
+	bare := ma.StringCast("/p2p/" + spub)
+	if st.CanDial(bare) {
+		t.Error("can dial", bare)
+	}
+	if _, err := st.Dial(context.Background(), bare, ""); err == nil {
+		t.Error("dialed", bare)
+	}
+}
+
+// TestLibp2pFallback connects to and from peers that don't negotiate SSH,
+// like the stock ws transport.
+func TestLibp2pFallback(t *testing.T) {
+	spriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(spriv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(spriv)
+	cid, _ := peer.IDFromPrivateKey(cpriv)
+
+	exchange := func(cc, sc tpt.CapableConn) {
+		if cc.RemotePeer() != sid || sc.RemotePeer() != cid {
+			t.Error("unexpected peers", cc.RemotePeer(), sc.RemotePeer())
+		}
+		go func() {
+			s, err := sc.AcceptStream()
+			if err != nil {
+				return
+			}
+			io.Copy(s, s)
+			s.Close()
+		}()
+		s, err := cc.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+			t.Error("unexpected echo", string(buf), err)
+		}
+		s.Close()
+	}
+
+	// Stock dialer to our listener.
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ach := make(chan tpt.CapableConn, 1)
+	go func() {
+		sc, _ := l.Accept()
+		ach <- sc
+	}()
+	u, _ := parseMultiaddr(l.Multiaddr())
+	wc, _, err := ws.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := ct.upgradeLibp2p(NewConn(wc), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := <-ach
+	if sc == nil {
+		t.Fatal("accept failed")
+	}
+	exchange(cc, sc)
+	cc.Close()
+	sc.Close()
+
+	// Our dialer to a stock listener.
+	sch := make(chan tpt.CapableConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&ws.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sc, _ := st.upgradeLibp2p(NewConn(c), nil, "")
+		sch <- sc
+	}))
+	defer srv.Close()
+	raddr, _ := manet.FromNetAddr(srv.Listener.Addr())
+	cc, err = ct.Dial(context.Background(), raddr.Encapsulate(ma.StringCast("/ws")), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc = <-sch
+	if sc == nil {
+		t.Fatal("upgrade failed")
+	}
+	exchange(cc, sc)
+	cc.Close()
+	sc.Close()
+
+	// TLS needs the peer ID, AllowAnyPeer only applies to SSH.
+	ct.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	if _, err := ct.Dial(context.Background(), raddr.Encapsulate(ma.StringCast("/ws")), ""); err != errFallbackNoPeerID {
+		t.Error("expected fallback without peer ID to fail", err)
+	}
+	if sc := <-sch; sc != nil {
+		t.Error("upgraded without peer ID")
+	}
+	ct.AllowAnyPeer = nil
+
+	ct.DisableFallback = true
+	if _, err := ct.Dial(context.Background(), raddr.Encapsulate(ma.StringCast("/ws")), sid); err == nil {
+		t.Error("fallback used when disabled")
+	}
+}
+
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r[name], nil
+}
+
+func TestDNSAddrs(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(priv)
+	other, _ := peer.Decode(spub)
+
+	if !ct.CanDial(ma.StringCast("/dns4/node.example/tcp/443/wss")) {
+		t.Error("can't dial dns4")
+	}
+
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port, _ := l.Multiaddr().ValueForProtocol(ma.P_TCP)
+	direct := "/ip4/127.0.0.1/tcp/" + port + "/ssh"
+
+	ct.Resolver = stubResolver{
+		"_dnsaddr.bootstrap.example": {
+			"dnsaddr=/ip4/127.0.0.1/tcp/1/ssh/p2p/" + other.Pretty(),
+			"dnsaddr=/dnsaddr/nested.example",
+		},
+		"_dnsaddr.nested.example": {
+			"dnsaddr=" + direct + "/p2p/" + sid.Pretty(),
+		},
+	}
+	addrs, err := ct.Resolve(context.Background(), ma.StringCast("/dnsaddr/bootstrap.example/p2p/"+sid.Pretty()))
+	if err != nil || len(addrs) != 1 {
+		t.Fatal("unexpected resolved addrs", addrs, err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	for _, a := range []string{"/dnsaddr/bootstrap.example/p2p/" + sid.Pretty(), "/dns4/localhost/tcp/" + port + "/ssh"} {
+		c, err := ct.Dial(context.Background(), ma.StringCast(a), sid)
+		if err != nil {
+			t.Fatal(a, err)
+		}
+		if c.RemotePeer() != sid {
+			t.Error("unexpected peer", c.RemotePeer())
+		}
+		if strings.HasPrefix(a, "/dnsaddr") && c.RemoteMultiaddr().String() != direct {
+			t.Error("resolved address not reported", c.RemoteMultiaddr())
+		}
+		c.Close()
+	}
+}
+
+func TestHTTPPathMount(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(priv)
+
+	a := ma.StringCast("/ip4/1.2.3.4/tcp/443/wss/http-path/p2p%2Fws")
+	if u, _ := parseMultiaddr(a); u != "wss://1.2.3.4:443/p2p/ws" {
+		t.Error("unexpected URL", u)
+	}
+	if !ct.CanDial(a) {
+		t.Error("can't dial", a)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ui"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	st.Mux = mux
+	st.Prefix = "/p2p"
+
+	saddr, _ := manet.FromNetAddr(srv.Listener.Addr())
+	l, err := st.Listen(saddr.Encapsulate(ma.StringCast("/ws")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpPath(l.Multiaddr()) != "/p2p" {
+		t.Fatal("path not advertised", l.Multiaddr())
+	}
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ct.Dial(context.Background(), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	resp, err := http.Get(srv.URL + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ui" {
+		t.Error("UI not served", string(body))
+	}
+
+	if _, err := st.Listen(saddr.Encapsulate(ma.StringCast("/ws"))); err == nil {
+		t.Error("path mounted twice")
+	}
+
+	l.Close()
+	if _, err := ct.Dial(context.Background(), l.Multiaddr(), sid); err == nil {
+		t.Error("dial to closed listener succeeded")
+	}
+
+	// The path can be mounted again once closed.
+	l, err = st.Listen(saddr.Encapsulate(ma.StringCast("/ws")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err = ct.Dial(context.Background(), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestExpandListenAddr(t *testing.T) {
+	ifaddrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1"),
+		ma.StringCast("/ip4/192.168.1.2"),
+		ma.StringCast("/ip4/8.8.4.4"),
+		ma.StringCast("/ip4/169.254.1.1"),
+		ma.StringCast("/ip6/::1"),
+		ma.StringCast("/ip6/fe80::1"),
+	}
+	st := &SSHTransport{}
+	laddr := ma.StringCast("/ip4/0.0.0.0/tcp/4001/wssh")
+	got := expandAddr(laddr, ifaddrs, st.keepListenAddr)
+	if len(got) != 4 || got[0].String() != "/ip4/8.8.4.4/tcp/4001/wssh" ||
+		got[3].String() != "/ip4/127.0.0.1/tcp/4001/wssh" {
+		t.Error("unexpected addrs", got)
+	}
+
+	st.ExcludeLoopback, st.ExcludeLinkLocal, st.ExcludePrivate = true, true, true
+	got = expandAddr(laddr, ifaddrs, st.keepListenAddr)
+	if len(got) != 1 || got[0].String() != "/ip4/8.8.4.4/tcp/4001/wssh" {
+		t.Error("unexpected filtered addrs", got)
+	}
+	got = expandAddr(ma.StringCast("/ip6/::/tcp/4001/wssh"), ifaddrs, st.keepListenAddr)
+	if len(got) != 0 {
+		t.Error("unexpected ip6 addrs", got)
+	}
+
+	// Port 0 is resolved.
+	l, err := (&SSHTransport{}).Listen(ma.StringCast("/ip4/0.0.0.0/tcp/0/wssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !manet.IsIPUnspecified(l.Multiaddr()) || strings.Contains(l.Multiaddr().String(), "/tcp/0/") {
+		t.Error("expected the bound address", l.Multiaddr())
+	}
+	for _, a := range l.(*listener).Multiaddrs() {
+		if manet.IsIPUnspecified(a) || strings.Contains(a.String(), "/tcp/0/") {
+			t.Error("unresolved listen address", a)
+		}
+	}
+}
+
+func TestGracefulClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(priv)
+
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ach := make(chan tpt.CapableConn, 1)
+	go func() {
+		sc, _ := l.Accept()
+		ach <- sc
+	}()
+	cc, err := ct.Dial(context.Background(), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := <-ach
+	if sc == nil {
+		t.Fatal("accept failed")
+	}
+
+	cs, err := cc.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- st.Close(ctx)
+	}()
+
+	// The client sees the goaway and stops opening streams.
+	for i := 0; ; i++ {
+		if s := newStream(cc.(*SSHConn), network.DirOutbound); cc.(*SSHConn).addStream(s) {
+			cc.(*SSHConn).streamDone(s)
+		} else {
+			break
+		}
+		if i > 100 {
+			t.Fatal("goaway not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cc.OpenStream(); err != errDraining {
+		t.Error("stream opened while draining", err)
+	}
+
+	// The open stream still works.
+	cs.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(ss, buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed with open streams")
+	default:
+	}
+	ss.Close()
+	cs.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't finish")
+	}
+
+	if _, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wssh")); err == nil {
+		t.Error("listen after close")
+	}
+	// Closed by the server, the client conn closes too.
+	for i := 0; !cc.IsClosed(); i++ {
+		if i > 100 {
+			t.Fatal("client conn not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// All goroutines exit.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i > 100 {
+			buf := make([]byte, 1<<16)
+			t.Fatal("goroutines left", runtime.NumGoroutine()-before, string(buf[:runtime.Stack(buf, true)]))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Connections closed by the remote are removed from the transport and
+// listener, and don't hold up Close.
+func TestRemoteCloseUntracked(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(priv)
+
+	ln, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ln.(*listener)
+	ach := make(chan tpt.CapableConn, 1)
+	go func() {
+		sc, _ := l.Accept()
+		ach <- sc
+	}()
+	cc, err := ct.Dial(context.Background(), l.Multiaddr(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc := <-ach; sc == nil {
+		t.Fatal("accept failed")
+	}
+	// A stream left open, so only the close ends the drain.
+	if _, err := cc.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked := func() int {
+		st.conns.mu.Lock()
+		defer st.conns.mu.Unlock()
+		l.conns.mu.Lock()
+		defer l.conns.mu.Unlock()
+		return len(st.conns.m) + len(l.conns.m)
+	}
+	if n := tracked(); n != 2 {
+		t.Fatal("accepted conn not tracked", n)
+	}
+	cc.Close()
+	for i := 0; tracked() > 0; i++ {
+		if i > 100 {
+			t.Fatal("remotely closed conn still tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	st.Close(ctx)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("close waited for a closed conn", d)
+	}
+}
+
+func TestConcurrentHandshakes(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	st, _ := NewSSHTransport(priv, nil, nil)
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	ct, _ := NewSSHTransport(cpriv, nil, nil)
+	sid, _ := peer.IDFromPrivateKey(priv)
+
+	st.HandshakeTimeout = 300 * time.Millisecond
+	herr := make(chan error, 1)
+	st.OnHandshakeError = func(remote net.Addr, err error) {
+		herr <- err
+	}
+
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A peer that never completes the handshake.
+	_, hostport, _ := manet.DialArgs(l.Multiaddr())
+	slow, err := net.Dial("tcp", hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	start := time.Now()
+	dch := make(chan tpt.CapableConn, 1)
+	go func() {
+		c, _ := ct.Dial(context.Background(), l.Multiaddr(), sid)
+		dch <- c
+	}()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if time.Since(start) > st.HandshakeTimeout {
+		t.Error("accept blocked by slow peer", time.Since(start))
+	}
+	if c := <-dch; c != nil {
+		defer c.Close()
+	}
+
+	select {
+	case err := <-herr:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Error("unexpected handshake error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("handshake error not reported")
+	}
+}
+
+// connPair returns two connected SSHConns, a is the server.
+func connPair(t *testing.T) (a, b *SSHConn) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	tr, _ := NewSSHTransport(priv, nil, nil)
+	tr.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	return transportConnPair(t, tr)
+}
+
+// transportConnPair connects the transport to itself.
+func transportConnPair(t *testing.T, tr *SSHTransport) (a, b *SSHConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ach := make(chan *SSHConn, 1)
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			ach <- nil
+			return
+		}
+		c, _ := tr.newCapableConn(nc, true, nil, "")
+		ach <- c
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = tr.newCapableConn(nc, false, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = <-ach
+	if a == nil {
+		t.Fatal("accept failed")
+	}
+	return a, b
+}
+
+func TestStreamReset(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	s, err := b.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Reset()
+	if _, err := rs.Write([]byte("x")); err != mux.ErrReset {
+		t.Error("write after local reset", err)
+	}
+
+	if _, err := ioutil.ReadAll(s); err != mux.ErrReset {
+		t.Error("read after remote reset", err)
+	}
+	if _, err := s.Write([]byte("x")); err != mux.ErrReset {
+		t.Error("write after remote reset", err)
+	}
+	s.Close()
+
+	// CloseRead discards the data, writes still work.
+	s, err = b.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi"))
+	rs, err = a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Read(make([]byte, 1)); err != errReadClosed {
+		t.Error("read after CloseRead", err)
+	}
+	// More than the SSH window.
+	go s.Write(make([]byte, 4<<20))
+	if _, err := rs.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	rs.Close()
+	buf, err := ioutil.ReadAll(s)
+	if err != nil || string(buf) != "ok" {
+		t.Error("write after CloseRead", string(buf), err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Error("CloseWrite after remote close", err)
+	}
+	s.Close()
+}
+
+// raceEnabled is set when built with -race.
+var raceEnabled bool
+
+func TestMuxSuite(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	tr, _ := NewSSHTransport(priv, nil, nil)
+	tr.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+
+	// SubtestWriteAfterClose runs both handshakes in the same goroutine,
+	// which doesn't work with SSH.
+	skip := reflect.ValueOf(muxtest.SubtestWriteAfterClose).Pointer()
+	openStress := reflect.ValueOf(muxtest.SubtestStreamOpenStress).Pointer()
+	for _, f := range muxtest.Subtests {
+		pc := reflect.ValueOf(f).Pointer()
+		if pc == skip {
+			continue
+		}
+		name := runtime.FuncForPC(pc).Name()
+		name = name[strings.LastIndex(name, ".")+1:]
+		f := f
+		t.Run(name, func(t *testing.T) {
+			if raceEnabled && pc == openStress {
+				t.Skip("50000 channel opens take longer than the 10s timeout with the race detector")
+			}
+			f(t, tr)
+		})
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	s, err := b.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi"))
+	rs, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	rs.Read(buf)
+	rs.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := rs.Read(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("expected read timeout", err)
+	}
+	rs.SetReadDeadline(time.Time{})
+	s.Write([]byte("again"))
+	if n, err := rs.Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Fatal("read after deadline extended", string(buf[:n]), err)
+	}
+
+	// More than the SSH window, nobody reading.
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	s.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := s.Write(data)
+	if err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("expected write timeout", n, err)
+	}
+	rch := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(rs)
+		rch <- got
+	}()
+	s.SetWriteDeadline(time.Time{})
+	if _, err := s.Write(data[n:]); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseWrite()
+	if got := <-rch; !bytes.Equal(got, data) {
+		t.Error("data lost or duplicated after write timeout", len(got))
+	}
+	s.Close()
+	rs.Close()
+}
+
+func TestConnStreams(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	if a.ID() == b.ID() || a.ID() == "" {
+		t.Error("conn IDs not unique", a.ID(), b.ID())
+	}
+	if a.Stat().Direction != network.DirInbound || b.Stat().Direction != network.DirOutbound {
+		t.Error("conn direction", a.Stat(), b.Stat())
+	}
+
+	s, err := b.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	rs, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.Conn() != b || rs.(network.Stream).Conn() != a {
+		t.Error("stream not linked to its conn")
+	}
+	if rs.(network.Stream).Stat().Direction != network.DirInbound {
+		t.Error("stream direction", rs.(network.Stream).Stat())
+	}
+
+	st := b.StreamStats()
+	if len(st) != 1 || st[0].ID != s.ID() || st[0].BytesWritten != 5 || st[0].Direction != network.DirOutbound {
+		t.Errorf("outbound stats %+v", st)
+	}
+	st = a.StreamStats()
+	if len(st) != 1 || st[0].BytesRead != 5 {
+		t.Errorf("inbound stats %+v", st)
+	}
+
+	s2, _ := b.NewStream()
+	if s2.ID() == s.ID() {
+		t.Error("stream IDs not unique", s.ID())
+	}
+	if n := len(b.GetStreams()); n != 2 {
+		t.Error("expected 2 streams", n)
+	}
+	s.Close()
+	s2.Reset()
+	if n := len(b.GetStreams()); n != 0 {
+		t.Error("closed streams still listed", n)
+	}
+}
+
+// A connection closed by the remote is closed locally too.
+func TestRemoteClose(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.AcceptStream()
+		errs <- err
+	}()
+	b.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("accepted a stream from a closed conn")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcceptStream blocked after remote close")
+	}
+	if !a.IsClosed() {
+		t.Error("remotely closed conn not closed")
+	}
+}
+
+func TestStreamProtocol(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.t.CheckStream = func(c *SSHConn, p protocol.ID, headers map[string]string) error {
+		switch {
+		case p == "/unknown/1.0":
+			return &StreamRejectedError{ssh.UnknownChannelType, "unsupported protocol"}
+		case headers["token"] == "bad":
+			return errors.New("bad token")
+		}
+		return nil
+	}
+
+	s, err := b.OpenStreamWithProtocol(context.Background(), "/echo/1.0", map[string]string{"token": "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("x"))
+	ms, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := ms.(*stream)
+	if rs.Protocol() != "/echo/1.0" || rs.Headers()["token"] != "ok" || s.Protocol() != "/echo/1.0" {
+		t.Error("protocol not received", rs.Protocol(), rs.Headers())
+	}
+	rs.SetProtocol("/other")
+	if rs.Protocol() != "/other" {
+		t.Error("SetProtocol", rs.Protocol())
+	}
+
+	_, err = b.OpenStreamWithProtocol(context.Background(), "/unknown/1.0", nil)
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.UnknownChannelType {
+		t.Error("expected unknown channel type", err)
+	}
+	_, err = b.OpenStreamWithProtocol(context.Background(), "/echo/1.0", map[string]string{"token": "bad"})
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.Prohibited || oe.Message != "bad token" {
+		t.Error("expected prohibited", err)
+	}
+	_, _, err = b.sshConn().OpenChannel(streamChannelType, []byte{0, 0, 0, 9, 'x'})
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.ConnectionFailed {
+		t.Error("expected malformed header rejected", err)
+	}
+
+	for _, c := range []ssh.Conn{a.sshConn(), b.sshConn()} {
+		_, _, err = c.OpenChannel("session", nil)
+		if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.UnknownChannelType {
+			t.Error("expected unknown channel type rejected", err)
+		}
+	}
+
+	// direct-tcpip carries the RFC 4254 forwarding target, not a header.
+	target := ssh.Marshal(&struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}{"localhost", 80, "127.0.0.1", 1234})
+	ch, reqs, err := b.sshConn().OpenChannel("direct-tcpip", target)
+	if err != nil {
+		t.Fatal("direct-tcpip rejected", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	ms, err = a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ms.(*stream).Protocol(); p != "" {
+		t.Error("direct-tcpip extra data parsed as header", p)
+	}
+	ms.Close()
+	ch.Close()
+
+	// Streams with a header opened by the server side.
+	s2, err := a.OpenStreamWithProtocol(context.Background(), "/echo/1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err = b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ms.(*stream).Protocol(); p != "/echo/1.0" {
+		t.Error("protocol not received by the client", p)
+	}
+	ms.Close()
+	s2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.OpenStreamWithProtocol(ctx, "/echo/1.0", nil); err != context.Canceled {
+		t.Error("expected canceled", err)
+	}
+	if n := len(b.GetStreams()); n != 1 {
+		t.Error("rejected streams still listed", n)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	tr, _ := NewSSHTransport(priv, nil, nil)
+	tr.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	tr.MaxPendingStreams = 2
+	tr.MaxInboundStreamsPerPeer = 3
+
+	a, b := transportConnPair(t, tr)
+	defer a.Close()
+	defer b.Close()
+
+	// Nobody accepting - the third is rejected.
+	for i := 0; i < 2; i++ {
+		if _, err := b.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := b.OpenStream()
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.ResourceShortage {
+		t.Fatal("expected resource shortage", err)
+	}
+	// Requests are still handled.
+	if ok, _, err := b.sshConn().SendRequest("keepalive@openssh.com", true, nil); !ok || err != nil {
+		t.Error("keepalive blocked", err)
+	}
+
+	s, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.OpenStream(); err != nil {
+		t.Fatal("pending slot not released", err)
+	}
+
+	// 3 open for the peer, also on another connection.
+	a2, b2 := transportConnPair(t, tr)
+	defer a2.Close()
+	defer b2.Close()
+	_, err = b2.OpenStream()
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.ResourceShortage {
+		t.Fatal("expected peer limit", err)
+	}
+	s.Close()
+	if _, err := b2.OpenStream(); err != nil {
+		t.Fatal("open slot not released", err)
+	}
+
+	// Closing the connection releases its streams.
+	a.Close()
+	b.Close()
+	if _, err := b2.OpenStream(); err != nil {
+		t.Fatal("streams of closed conn not released", err)
+	}
+
+	st := tr.StreamRejectStats()
+	if st[RejectPendingStreams] != 1 || st[RejectPeerInboundStreams] != 1 {
+		t.Error("unexpected stats", st)
+	}
+}
+
+// Streams reset before AcceptStream keep their pending slot until dequeued,
+// and don't block the channel loop.
+func TestStreamResetWhilePending(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	tr, _ := NewSSHTransport(priv, nil, nil)
+	tr.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	tr.MaxPendingStreams = 2
+
+	a, b := transportConnPair(t, tr)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 2; i++ {
+		s, err := b.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Reset()
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(a.GetStreams()) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("resets not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.OpenStream()
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.ResourceShortage {
+			t.Fatal("expected resource shortage", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel loop blocked")
+	}
+	if ok, _, err := b.sshConn().SendRequest("keepalive@openssh.com", true, nil); !ok || err != nil {
+		t.Error("keepalive blocked", err)
+	}
+
+	// AcceptStream skips the reset streams, releasing their slots.
+	accepted := make(chan mux.MuxedStream, 1)
+	go func() {
+		s, err := a.AcceptStream()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- s
+	}()
+	s, err := b.OpenStream()
+	for i := 0; err != nil && i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s, err = b.OpenStream()
+	}
+	if err != nil {
+		t.Fatal("pending slots not released", err)
+	}
+	s.Write([]byte("x"))
+	rs := <-accepted
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(rs, buf); err != nil || buf[0] != 'x' {
+		t.Fatal("accepted a reset stream", err)
+	}
+
+	tr.streamLimitMu.Lock()
+	pending, open := a.inStreams.pending, a.inStreams.open
+	tr.streamLimitMu.Unlock()
+	if pending != 0 || open != 1 {
+		t.Error("unexpected counts", pending, open)
+	}
+}
+
+// testRM is a ResourceManager with a memory budget.
+type testRM struct {
+	mu       sync.Mutex
+	maxMem   int
+	maxConns int
+	mem      int
+	conns    int
+	streams  int
+	peers    []peer.ID
+	protos   []protocol.ID
+}
+
+type testScope struct {
+	rm     *testRM
+	stream bool
+}
+
+func (rm *testRM) OpenConnection(dir network.Direction, usefd bool, endpoint ma.Multiaddr) (ConnManagementScope, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.conns >= rm.maxConns {
+		return nil, errors.New("too many conns")
+	}
+	rm.conns++
+	return &testScope{rm: rm}, nil
+}
+
+func (rm *testRM) OpenStream(p peer.ID, dir network.Direction) (StreamManagementScope, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.streams++
+	return &testScope{rm: rm, stream: true}, nil
+}
+
+func (s *testScope) ReserveMemory(size int, prio uint8) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.rm.mem+size > s.rm.maxMem {
+		return errors.New("out of memory")
+	}
+	s.rm.mem += size
+	return nil
+}
+
+func (s *testScope) ReleaseMemory(size int) {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	s.rm.mem -= size
+}
+
+func (s *testScope) SetPeer(p peer.ID) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	s.rm.peers = append(s.rm.peers, p)
+	return nil
+}
+
+func (s *testScope) SetProtocol(p protocol.ID) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	s.rm.protos = append(s.rm.protos, p)
+	return nil
+}
+
+func (s *testScope) Done() {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.stream {
+		s.rm.streams--
+	} else {
+		s.rm.conns--
+	}
+}
+
+func (rm *testRM) usage() (mem, conns, streams int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.mem, rm.conns, rm.streams
+}
+
+func TestResourceManager(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	tr, _ := NewSSHTransport(priv, nil, nil)
+	tr.AllowAnyPeer = func(ma.Multiaddr) bool { return true }
+	// Both ends of 2 conns and 3 streams.
+	rm := &testRM{maxConns: 2, maxMem: 2*connMemory + 3*streamMemory}
+	tr.ResourceManager = rm
+
+	a, b := transportConnPair(t, tr)
+	if mem, conns, _ := rm.usage(); mem != 2*connMemory || conns != 2 || len(rm.peers) != 2 {
+		t.Fatal("conn scopes", mem, conns, rm.peers)
+	}
+
+	s, err := b.OpenStreamWithProtocol(context.Background(), "/echo/1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := a.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, streams := rm.usage(); streams != 2 || len(rm.protos) != 2 {
+		t.Error("stream scopes", streams, rm.protos)
+	}
+	// One left - the outbound side fits, the inbound is refused.
+	_, err = b.OpenStream()
+	if oe, ok := err.(*ssh.OpenChannelError); !ok || oe.Reason != ssh.ResourceShortage {
+		t.Fatal("expected resource shortage", err)
+	}
+	if tr.StreamRejectStats()[RejectResourceLimit] != 1 {
+		t.Error("rejection not counted", tr.StreamRejectStats())
+	}
+	// No conn left.
+	nc, _ := net.Pipe()
+	if _, err := tr.newCapableConn(nc, false, nil, ""); err == nil {
+		t.Error("conn over the limit")
+	}
+
+	// Released on close and reset.
+	s.Close()
+	rs.Reset()
+	if mem, _, streams := rm.usage(); streams != 0 || mem != 2*connMemory {
+		t.Error("stream scopes not released", mem, streams)
+	}
+
+	a.Close()
+	b.Close()
+	if mem, conns, _ := rm.usage(); mem != 0 || conns != 0 {
+		t.Error("conn scopes not released", mem, conns)
+	}
+}
+
+// stubGater denies the stages set to true.
+type stubGater struct {
+	denyDial, denyAccept, denySecured, denyUpgraded bool
+}
+
+func (g *stubGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.denyDial
+}
+
+func (g *stubGater) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	return !g.denyDial
+}
+
+func (g *stubGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return !g.denyAccept
+}
+
+func (g *stubGater) InterceptSecured(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+	return !g.denySecured
+}
+
+func (g *stubGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	if g.denyUpgraded {
+		return false, 7
+	}
+	return true, 0
+}
+
+func TestGater(t *testing.T) {
+	priv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	sg := &stubGater{}
+	st, _ := NewSSHTransport(priv, nil, sg)
+	sid, _ := peer.IDFromPrivateKey(priv)
+	herr := make(chan error, 10)
+	st.OnHandshakeError = func(remote net.Addr, err error) {
+		herr <- err
+	}
+
+	cpriv, _, _ := ic.GenerateKeyPair(ic.Ed25519, 0)
+	cg := &stubGater{}
+	ct, _ := NewSSHTransport(cpriv, nil, cg)
+
+	l, err := st.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0/wssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	dial := func() (tpt.CapableConn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return ct.Dial(ctx, l.Multiaddr(), sid)
+	}
+	expectErr := func(stage string, err error, want string) {
+		t.Helper()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", stage, want, err)
+		}
+	}
+
+	cg.denyDial = true
+	_, err = dial()
+	if !errors.Is(err, errGated) {
+		t.Error("dial not gated", err)
+	}
+	cg.denyDial = false
+
+	sg.denyAccept = true
+	_, err = dial()
+	expectErr("accept", err, "403")
+	sg.denyAccept = false
+
+	// Denied by the server, the client gets the reason in the close frame.
+	sg.denySecured = true
+	_, err = dial()
+	expectErr("inbound secured", err, "connection gated: secured")
+	expectErr("inbound secured, server", <-herr, "connection gated")
+	sg.denySecured = false
+
+	// Denied by the client, the server gets the reason.
+	cg.denySecured = true
+	_, err = dial()
+	if !errors.Is(err, errGated) {
+		t.Error("outbound secured not gated", err)
+	}
+	expectErr("outbound secured, server", <-herr, "connection gated: secured")
+	cg.denySecured = false
+
+	// The handshake completes on the client, then the server closes.
+	sg.denyUpgraded = true
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErr("inbound upgraded", c.(*SSHConn).sshConn().Wait(), "connection gated: upgraded (reason 7)")
+	c.Close()
+	sg.denyUpgraded = false
+
+	if st.DropStats()[DropGated] == 0 {
+		t.Error("gated connections not counted", st.DropStats())
+	}
+}
@@ -1,10 +1,16 @@
 package wstransport
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	"golang.org/x/crypto/ssh"
@@ -18,12 +24,155 @@ import (
 // - CloseWrite, CloseRead, Reset for MuxedStream.
 // CloseWrite is also implemented in http (closeWriter - not public)
 
+// Reset: SSH has no equivalent, closing a channel looks like a clean close.
+// The side resetting sends a resetRequest and closes after the reply. The
+// remote marks the stream reset before replying, so its Read and Write
+// return mux.ErrReset and never a plain EOF.
+
+// resetRequest is the channel request sent by Reset.
+const resetRequest = "reset@libp2p.io"
+
+var (
+	errReadClosed  = errors.New("stream closed for reading")
+	errWriteClosed = errors.New("stream closed for writing")
+)
+
+var _ network.Stream = (*stream)(nil)
+
 // Implements MuxedStream AND net.Conn
 // Also implements ssh.Channel - add SendRequest and Stderr, as well as CloseWrite
 type stream struct {
-	con *SSHConn
-	ch ssh.Channel
+	// Updated atomically, first for alignment.
+	bytesRead    uint64
+	bytesWritten uint64
+
+	con  *SSHConn
+	ch   ssh.Channel
 	stat network.Stat
+
+	// Set by addStream, unique in the connection.
+	id uint64
+
+	// For the inbound stream limits, guarded by the transport streamLimitMu.
+	limitState int
+
+	// Resource manager scope, nil if not used.
+	scope     StreamManagementScope
+	scopeOnce sync.Once
+
+	// From the stream header, or SetProtocol.
+	proto   protocol.ID
+	headers map[string]string
+
+	mu          sync.Mutex
+	reset       bool // local or remote Reset
+	resetCh     chan struct{}
+	readClosed  bool
+	writeClosed bool
+
+	// Background read - the data not returned yet, and the error after it.
+	rmu     sync.Mutex
+	rdl     *deadline
+	reading bool
+	rdone   chan readResult
+	rmem    []byte
+	rbuf    []byte
+	rerr    error
+
+	// Background write of a copy of the data.
+	wmu     sync.Mutex
+	wdl     *deadline
+	writing bool
+	wdone   chan error
+	wmem    []byte
+
+	doneOnce sync.Once
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// newStream returns a stream of the connection, attached to its channel
+// once open.
+func newStream(c *SSHConn, dir network.Direction) *stream {
+	return &stream{
+		con:     c,
+		stat:    network.Stat{Direction: dir, Opened: time.Now()},
+		resetCh: make(chan struct{}),
+		rdl:     newDeadline(),
+		rdone:   make(chan readResult, 1),
+		wdl:     newDeadline(),
+		wdone:   make(chan error, 1),
+	}
+}
+
+// attach sets the open channel, handling its requests.
+func (c *stream) attach(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	c.ch = ch
+	go c.handleRequests(reqs)
+}
+
+// handleRequests handles the in-band requests - only resetRequest, others
+// are refused.
+func (c *stream) handleRequests(reqs <-chan *ssh.Request) {
+	for r := range reqs {
+		if r.Type != resetRequest {
+			r.Reply(false, nil)
+			continue
+		}
+		c.setReset()
+		r.Reply(true, nil)
+		c.ch.Close()
+		c.done()
+	}
+}
+
+// setReset marks the stream reset, returning false if it already was.
+func (c *stream) setReset() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return false
+	}
+	c.reset = true
+	close(c.resetCh)
+	return true
+}
+
+// done is called when the stream is closed locally or reset.
+func (c *stream) done() {
+	c.doneOnce.Do(func() {
+		c.con.streamDone(c)
+		if c.stat.Direction == network.DirInbound {
+			c.con.t.inboundStreamDone(c)
+		}
+	})
+}
+
+func (c *stream) readErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return mux.ErrReset
+	}
+	if c.readClosed {
+		return errReadClosed
+	}
+	return nil
+}
+
+func (c *stream) writeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return mux.ErrReset
+	}
+	if c.writeClosed {
+		return errWriteClosed
+	}
+	return nil
 }
 
 // net.Conn only
@@ -52,42 +201,210 @@ func (c *stream) Stderr() io.ReadWriter {
 
 // Common
 func (c *stream) Read(p []byte) (n int, err error) {
-	return c.ch.Read(p)
+	if err := c.readErr(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.rbuf) == 0 && c.rerr == nil {
+		if !c.reading {
+			c.startRead(len(p))
+		}
+		select {
+		case r := <-c.rdone:
+			c.reading = false
+			c.rbuf, c.rerr = c.rmem[:r.n], r.err
+		case <-c.rdl.wait():
+			return 0, errTimeout
+		case <-c.resetCh:
+			return 0, mux.ErrReset
+		}
+	}
+
+	n = copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	if len(c.rbuf) > 0 || c.rerr == nil {
+		return n, nil
+	}
+	err, c.rerr = c.rerr, nil
+	// Reset while reading, or the remote reset and closed.
+	if rerr := c.readErr(); rerr != nil {
+		return n, rerr
+	}
+	return n, err
+}
+
+// startRead reads from the channel in the background, into rmem.
+func (c *stream) startRead(n int) {
+	if n > streamChunk {
+		n = streamChunk
+	}
+	if cap(c.rmem) < n {
+		c.rmem = make([]byte, n)
+	}
+	buf := c.rmem[:n]
+	c.reading = true
+	go func() {
+		n, err := c.ch.Read(buf)
+		c.rdone <- readResult{n, err}
+	}()
 }
 
+// Write sends p in chunks, each copied and written in the background. When
+// the deadline expires the last chunk may still be in flight - it is counted
+// as written, and sent before the next Write.
 func (c *stream) Write(p []byte) (n int, err error) {
-	return c.ch.Write(p)
+	if err := c.writeErr(); err != nil {
+		return 0, err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	defer func() {
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+	}()
+
+	for {
+		if err := c.waitWrite(); err != nil {
+			return n, err
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		chunk := p[n:]
+		if len(chunk) > streamChunk {
+			chunk = chunk[:streamChunk]
+		}
+		c.wmem = append(c.wmem[:0], chunk...)
+		buf := c.wmem
+		c.writing = true
+		go func() {
+			_, err := c.ch.Write(buf)
+			c.wdone <- err
+		}()
+		n += len(chunk)
+	}
+}
+
+// waitWrite waits for the background write, if any. Called with wmu held.
+func (c *stream) waitWrite() error {
+	select {
+	case <-c.wdl.wait():
+		return errTimeout
+	default:
+	}
+	if !c.writing {
+		return nil
+	}
+	select {
+	case err := <-c.wdone:
+		c.writing = false
+		if err != nil {
+			if werr := c.writeErr(); werr != nil {
+				return werr
+			}
+		}
+		return err
+	case <-c.wdl.wait():
+		return errTimeout
+	case <-c.resetCh:
+		return mux.ErrReset
+	}
+}
+
+// flush waits for the pending write, before CloseWrite. Close doesn't wait,
+// a write still pending after a timeout is dropped.
+func (c *stream) flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.writing {
+		return nil
+	}
+	return c.waitWrite()
 }
 
 func (c *stream) Close() error {
+	c.done()
 	return c.ch.Close()
 }
 
+// CloseRead discards the data received from now on, writes are still
+// allowed.
 // MuxedStream only
 func (c *stream) CloseRead() error {
-	return c.ch.Close()
+	c.mu.Lock()
+	if c.readClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.readClosed = true
+	both := c.writeClosed
+	c.mu.Unlock()
+	if both {
+		return c.Close()
+	}
+	// Keep reading, so the remote is not blocked by the window.
+	go io.Copy(ioutil.Discard, c.ch)
+	return nil
 }
 
+// Reset closes both directions, the remote gets mux.ErrReset.
 // MuxedStream only
 func (c *stream) Reset() error {
-	return c.ch.Close()
+	if !c.setReset() {
+		return nil
+	}
+	c.done()
+	go func() {
+		// The reply, or an error if the channel is closed. Peers that don't
+		// know the request refuse it.
+		c.ch.SendRequest(resetRequest, true, nil)
+		c.ch.Close()
+	}()
+	return nil
 }
 
 // MuxedStream and ssh.Channel
 func (c *stream) CloseWrite() error {
-	return c.ch.CloseWrite()
+	c.mu.Lock()
+	if c.writeClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	both := c.readClosed
+	c.mu.Unlock()
+	if both {
+		return c.Close()
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if err := c.ch.CloseWrite(); err != io.EOF {
+		return err
+	}
+	// Already closed by the remote.
+	return nil
 }
 
 // MuxedStream and net.Conn
 func (c *stream) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
 	return nil
 }
 
 func (c *stream) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
 	return nil
 }
 
 func (c *stream) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
 	return nil
 }
 
@@ -100,14 +417,42 @@ func (c *stream) Conn() network.Conn {
 }
 
 func (c *stream) Protocol() protocol.ID {
-	return ""
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proto
+}
+
+// Headers returns the metadata sent with the protocol when the stream was
+// opened.
+func (c *stream) Headers() map[string]string {
+	return c.headers
 }
 
 func (c *stream) ID() string {
-	return ""
+	return c.con.ID() + "-" + strconv.FormatUint(c.id, 10)
+}
+
+func (c *stream) stats() StreamStats {
+	return StreamStats{
+		ID:           c.ID(),
+		Direction:    c.stat.Direction,
+		Opened:       c.stat.Opened,
+		BytesRead:    atomic.LoadUint64(&c.bytesRead),
+		BytesWritten: atomic.LoadUint64(&c.bytesWritten),
+	}
 }
 
+// SetProtocol sets the protocol, also in the resource manager scope - the
+// stream is reset if the protocol is over its limits.
 func (c *stream) SetProtocol(id protocol.ID) {
+	c.mu.Lock()
+	c.proto = id
+	c.mu.Unlock()
+	if c.scope != nil {
+		if err := c.scope.SetProtocol(id); err != nil {
+			c.Reset()
+		}
+	}
 }
 
 
@@ -0,0 +1,189 @@
+package wstransport
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Limits on inbound streams. A stream is pending from the channel open until
+// AcceptStream returns it, and open until closed or reset. Channels over a
+// limit are rejected with ssh.ResourceShortage, without blocking the other
+// channels and requests of the connection.
+
+// DefaultMaxPendingStreams is used if SSHTransport.MaxPendingStreams is not
+// set. Same as the yamux accept backlog.
+var DefaultMaxPendingStreams = 256
+
+// DefaultMaxInboundStreams is used if SSHTransport.MaxInboundStreams is not
+// set.
+var DefaultMaxInboundStreams = 1024
+
+// Reasons for rejecting inbound streams, counted in StreamRejectStats.
+const (
+	RejectPendingStreams     = "pending-streams"
+	RejectInboundStreams     = "inbound-streams"
+	RejectPeerPendingStreams = "peer-pending-streams"
+	RejectPeerInboundStreams = "peer-inbound-streams"
+)
+
+// streamCount is the number of inbound streams of a connection or peer.
+type streamCount struct {
+	pending int
+	open    int
+}
+
+// StreamRejectStats returns the number of inbound streams rejected, by
+// reason.
+func (t *SSHTransport) StreamRejectStats() map[string]uint64 {
+	t.dropMu.Lock()
+	defer t.dropMu.Unlock()
+	res := map[string]uint64{}
+	for k, v := range t.streamRejects {
+		res[k] = v
+	}
+	return res
+}
+
+func (t *SSHTransport) countStreamReject(reason string) {
+	t.dropMu.Lock()
+	defer t.dropMu.Unlock()
+	if t.streamRejects == nil {
+		t.streamRejects = map[string]uint64{}
+	}
+	t.streamRejects[reason]++
+}
+
+// State of an inbound stream in the counts. A queued stream closed or reset
+// before AcceptStream keeps its pending slot until it leaves the queue, the
+// queue has room for the pending streams only.
+const (
+	streamUncounted = iota
+	streamPending
+	streamQueued
+	streamOpen
+	streamDropped
+)
+
+// admitStream counts a new inbound stream as pending, returning the reason
+// if over a limit.
+func (t *SSHTransport) admitStream(c *SSHConn, s *stream) string {
+	t.streamLimitMu.Lock()
+	defer t.streamLimitMu.Unlock()
+	if c.streamsReleased {
+		return errClosed.Error()
+	}
+
+	ps := t.peerStreams[c.remoteID]
+	if ps == nil {
+		ps = &streamCount{}
+	}
+	reason := ""
+	switch {
+	case c.inStreams.pending >= t.maxPendingStreams():
+		reason = RejectPendingStreams
+	case c.inStreams.open >= t.maxInboundStreams():
+		reason = RejectInboundStreams
+	case t.MaxPendingStreamsPerPeer > 0 && ps.pending >= t.MaxPendingStreamsPerPeer:
+		reason = RejectPeerPendingStreams
+	case t.MaxInboundStreamsPerPeer > 0 && ps.open >= t.MaxInboundStreamsPerPeer:
+		reason = RejectPeerInboundStreams
+	}
+	if reason != "" {
+		t.countStreamReject(reason)
+		return reason
+	}
+
+	if t.peerStreams == nil {
+		t.peerStreams = map[peer.ID]*streamCount{}
+	}
+	t.peerStreams[c.remoteID] = ps
+	s.limitState = streamPending
+	t.addStreamCount(c, 1, 1)
+	return ""
+}
+
+// streamQueued is called before an accepted channel is queued for
+// AcceptStream.
+func (t *SSHTransport) streamQueued(s *stream) {
+	t.streamLimitMu.Lock()
+	defer t.streamLimitMu.Unlock()
+	if s.limitState == streamPending {
+		s.limitState = streamQueued
+	}
+}
+
+// streamAccepted is called when a stream leaves the queue, returning false
+// if it was closed or reset while queued.
+func (t *SSHTransport) streamAccepted(s *stream) bool {
+	t.streamLimitMu.Lock()
+	defer t.streamLimitMu.Unlock()
+	switch s.limitState {
+	case streamQueued:
+		s.limitState = streamOpen
+		t.addStreamCount(s.con, -1, 0)
+	case streamDropped:
+		s.limitState = streamUncounted
+		t.addStreamCount(s.con, -1, 0)
+		return false
+	}
+	return true
+}
+
+// inboundStreamDone is called when an inbound stream is closed or reset,
+// accepted or not.
+func (t *SSHTransport) inboundStreamDone(s *stream) {
+	t.streamLimitMu.Lock()
+	defer t.streamLimitMu.Unlock()
+	switch s.limitState {
+	case streamPending:
+		t.addStreamCount(s.con, -1, -1)
+		s.limitState = streamUncounted
+	case streamQueued:
+		t.addStreamCount(s.con, 0, -1)
+		s.limitState = streamDropped
+	case streamOpen:
+		t.addStreamCount(s.con, 0, -1)
+		s.limitState = streamUncounted
+	}
+}
+
+// releaseStreams removes the streams of a closed connection from the peer
+// counts.
+func (t *SSHTransport) releaseStreams(c *SSHConn) {
+	t.streamLimitMu.Lock()
+	defer t.streamLimitMu.Unlock()
+	t.addStreamCount(c, -c.inStreams.pending, -c.inStreams.open)
+	c.streamsReleased = true
+}
+
+// addStreamCount updates the counts of the connection and its peer, unless
+// released. Called with streamLimitMu held.
+func (t *SSHTransport) addStreamCount(c *SSHConn, pending, open int) {
+	if c.streamsReleased {
+		return
+	}
+	c.inStreams.pending += pending
+	c.inStreams.open += open
+	ps := t.peerStreams[c.remoteID]
+	if ps == nil {
+		return
+	}
+	ps.pending += pending
+	ps.open += open
+	if ps.pending <= 0 && ps.open <= 0 {
+		delete(t.peerStreams, c.remoteID)
+	}
+}
+
+func (t *SSHTransport) maxPendingStreams() int {
+	if t.MaxPendingStreams > 0 {
+		return t.MaxPendingStreams
+	}
+	return DefaultMaxPendingStreams
+}
+
+func (t *SSHTransport) maxInboundStreams() int {
+	if t.MaxInboundStreams > 0 {
+		return t.MaxInboundStreams
+	}
+	return DefaultMaxInboundStreams
+}
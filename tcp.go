@@ -0,0 +1,96 @@
+package wstransport
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Plain TCP variant - /ip4/.../tcp/.../ssh - for networks where the WebSocket
+// framing is not needed. Identity, gating and crypto are the same as for WS,
+// a node can listen on both.
+
+func (t *SSHTransport) tcpDial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if err := t.interceptDial(raddr, p); err != nil {
+		return nil, err
+	}
+
+	tcpaddr, _ := ma.SplitLast(raddr)
+	var d manet.Dialer
+	nc, err := d.DialContext(ctx, tcpaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := t.newCapableConn(nc, false, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *SSHTransport) tcpListen(a ma.Multiaddr) (transport.Listener, error) {
+	tcpaddr, _ := ma.SplitLast(a)
+	nl, err := manet.Listen(tcpaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := t.wrapListener(manet.NetListener(nl), nl.Multiaddr().Encapsulate(ma.StringCast("/ssh")))
+	l.addr = nl.Addr()
+	go l.serveTCP()
+	return l, nil
+}
+
+// serveTCP accepts TCP connections, applying the same admission checks as
+// the WS listener before the handshake.
+func (l *listener) serveTCP() {
+	defer l.Close()
+	for {
+		nc, err := l.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		if !l.admitTCP(nc) {
+			nc.Close()
+			continue
+		}
+		l.enqueue(nc)
+	}
+}
+
+// admitTCP checks the rate limit, gater and pending handshakes for a new
+// connection, taking a pending slot if admitted.
+func (l *listener) admitTCP(nc net.Conn) bool {
+	if l.limiter != nil && !l.limiter.allow(dialHost(nc.RemoteAddr().String()), time.Now()) {
+		l.t.countDrop(DropRateLimited)
+		return false
+	}
+	if l.t.Gater != nil {
+		raddr, err := manet.FromNetAddr(nc.RemoteAddr())
+		if err != nil {
+			return false
+		}
+		addrs := &connAddrs{laddr: l.laddr, raddr: raddr.Encapsulate(ma.StringCast("/ssh"))}
+		if !l.t.Gater.InterceptAccept(addrs) {
+			l.t.countDrop(DropGated)
+			return false
+		}
+	}
+	select {
+	case l.pending <- struct{}{}:
+		return true
+	default:
+		l.t.countDrop(DropTooManyPending)
+		return false
+	}
+}
@@ -2,13 +2,20 @@ package wstransport
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
 	ma "github.com/multiformats/go-multiaddr"
 	"golang.org/x/crypto/ssh"
 )
@@ -22,19 +29,158 @@ type SSHTransport struct {
 	Mux    *http.ServeMux
 
 	Gater        connmgr.ConnectionGater
+	// Psk, if set, only allows connections with peers in the same private
+	// network. Peers without the key fail with ErrPSKMismatch.
 	Psk          pnet.PSK
 	Key          ic.PrivKey
-	serverConfig *ssh.ServerConfig
-	clientConfig *ssh.ClientConfig
+
+	// AllowAnyPeer is consulted when dialing without a peer ID. If it returns
+	// true, any remote host key is accepted - for example for bootstrap
+	// discovery. By default dials without a peer ID fail.
+	AllowAnyPeer func(raddr ma.Multiaddr) bool
+
+	// KnownHosts, if set, is used for dials without a peer ID instead of
+	// AllowAnyPeer: the host key is pinned on first use.
+	KnownHosts *KnownHosts
+
+	// UserCAs are trusted to sign certificates of connecting peers, HostCAs
+	// to sign certificates of peers we dial.
+	UserCAs []ssh.PublicKey
+	HostCAs []ssh.PublicKey
+
+	// CertCriticalOptions are the certificate critical options accepted in
+	// addition to source-address. Certificates with other options are rejected.
+	CertCriticalOptions []string
+
+	// AuthorizedKeys, if set, is the allowlist for inbound connections.
+	AuthorizedKeys *AuthorizedKeys
+
+	// AllowedOrigins are the browser origins allowed to connect - exact,
+	// like "https://app.example.com", or "https://*.example.com" for any
+	// subdomain. "*" allows all. By default only requests without Origin,
+	// from non-browser clients, are accepted.
+	AllowedOrigins []string
+
+	// AllowedHosts, if set, restricts the Host header of incoming requests,
+	// to block DNS rebinding. Same format, without scheme; a pattern without
+	// port matches any port.
+	AllowedHosts []string
+
+	// TLSConfig is used by listeners on /wss or /tls/ws addresses, and must
+	// have a certificate.
+	TLSConfig *tls.Config
+
+	// ClientTLSConfig is used when dialing /wss or /tls/ws addresses. The
+	// ServerName defaults to the dialed host - set it for SNI or for
+	// verifying IP addresses against a name. Peers are authenticated by SSH,
+	// TLS verification only matters for the intermediaries.
+	ClientTLSConfig *tls.Config
+
+	// DisableFallback rejects peers without SSH support, instead of using
+	// the standard libp2p TLS and yamux/mplex upgrade.
+	DisableFallback bool
+
+	// HandshakeTimeout bounds the SSH handshake, DefaultHandshakeTimeout if
+	// not set.
+	HandshakeTimeout time.Duration
+
+	// MaxPendingHandshakes caps the inbound connections per listener that are
+	// not yet authenticated, DefaultMaxPendingHandshakes if not set.
+	MaxPendingHandshakes int
+
+	// HandshakeWorkers is the number of inbound handshakes run concurrently
+	// per listener, DefaultHandshakeWorkers if not set. Others wait, up to
+	// MaxPendingHandshakes.
+	HandshakeWorkers int
+
+	// AcceptBacklog is the number of authenticated connections waiting for
+	// Accept, DefaultAcceptBacklog if not set. Handshakes pause when full.
+	AcceptBacklog int
+
+	// OnHandshakeError, if set, is called for failed inbound handshakes.
+	OnHandshakeError func(remote net.Addr, err error)
+
+	// ConnRateLimit, if set, is the number of new inbound connections per
+	// second allowed from a source IP, with bursts of ConnRateBurst.
+	ConnRateLimit float64
+	ConnRateBurst int
+
+	// Interface addresses skipped when reporting the addresses of listeners
+	// on 0.0.0.0 or ::.
+	ExcludeLoopback  bool
+	ExcludeLinkLocal bool
+	ExcludePrivate   bool
+
+	// MaxPendingStreams caps the inbound streams of a connection not yet
+	// returned by AcceptStream, DefaultMaxPendingStreams if not set.
+	MaxPendingStreams int
+
+	// MaxInboundStreams caps the open inbound streams of a connection,
+	// DefaultMaxInboundStreams if not set.
+	MaxInboundStreams int
+
+	// MaxPendingStreamsPerPeer and MaxInboundStreamsPerPeer, if set, are the
+	// same limits over all connections of a peer.
+	MaxPendingStreamsPerPeer int
+	MaxInboundStreamsPerPeer int
+
+	// CheckStream, if set, is called for incoming streams with the protocol
+	// and headers sent by OpenStreamWithProtocol - empty for OpenStream. An
+	// error refuses the stream, see StreamRejectedError. It runs in the
+	// connection's channel loop and should not block.
+	CheckStream func(c *SSHConn, p protocol.ID, headers map[string]string) error
+
+	// ResourceManager, if set, accounts connections, streams and their
+	// memory. Connections and streams over the limits are refused.
+	ResourceManager ResourceManager
+
+	// Resolver is used for /dnsaddr, net.DefaultResolver if not set.
+	Resolver Resolver
+
+	// CryptoPolicy selects the SSH algorithms, ModernCryptoPolicy if nil.
+	// The policy must allow the node key type - the default doesn't allow
+	// RSA. Checked by SetCryptoPolicy, Listen and Dial.
+	CryptoPolicy *CryptoPolicy
+
+	// Signers used to authenticate to servers, user certificate first.
+	userSigners []ssh.Signer
 	signer       ssh.Signer
+	hostCert     ssh.Signer
+
+	dropMu        sync.Mutex
+	drops         map[string]uint64
+	streamRejects map[string]uint64
+
+	// Inbound streams by peer, for the per peer limits.
+	streamLimitMu sync.Mutex
+	peerStreams   map[peer.ID]*streamCount
+
+	// Listeners and connections, for Close.
+	connsMu   sync.Mutex
+	isClosed  bool
+	listeners map[*listener]struct{}
+	conns     connSet
+
+	// Listeners mounted on Mux, by path. Nil once closed - the path stays
+	// registered.
+	mountsMu sync.Mutex
+	mounts   map[string]*listener
+
+	upgraderOnce sync.Once
+	upgrader     *tptu.Upgrader
+	upgraderErr  error
 }
 
 func (t *SSHTransport) CanDial(a ma.Multiaddr) bool {
-	return dialMatcher.Matches(a)
+	a, _, err := splitP2P(a)
+	if err != nil {
+		return false
+	}
+	return isDNSAddr(a) || dialMatcher.Matches(a) || sshDialMatcher.Matches(a)
 }
 
 func (t *SSHTransport) Protocols() []int {
-	return []int{ma.P_WS}
+	return []int{P_WSSH, ma.P_WS, ma.P_WSS, P_SSH}
 }
 
 func (t *SSHTransport) Proxy() bool {
@@ -45,15 +191,52 @@ func (t *SSHTransport) Proxy() bool {
 // using an address. The ID is derived from the proto-representation of the key - either
 // SHA256 or the actual key if len <= 42
 func (t *SSHTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if err := t.closedErr(); err != nil {
+		return nil, err
+	}
+	if err := checkNodeKey(t.cryptoPolicy(), t.signer); err != nil {
+		return nil, err
+	}
+	raddr, id, err := splitP2P(raddr)
+	if err != nil {
+		return nil, err
+	}
+	if p == "" {
+		p = id
+	} else if id != "" && id != p {
+		return nil, fmt.Errorf("dial %s: address is for peer %s", p, id)
+	}
+
+	if isDNSAddr(raddr) {
+		return t.dialDNSAddr(ctx, raddr, p)
+	}
+	if sshDialMatcher.Matches(raddr) {
+		return t.tcpDial(ctx, raddr, p)
+	}
 	// Implemented in one of the WS libraries. Need to find the most efficient.
 	return t.maDial(ctx, raddr, p)
 }
 
 func (t *SSHTransport) Listen(a ma.Multiaddr) (transport.Listener, error) {
-	malist, err := t.maListen(a)
+	if err := t.closedErr(); err != nil {
+		return nil, err
+	}
+	if err := checkNodeKey(t.cryptoPolicy(), t.signer); err != nil {
+		return nil, err
+	}
+	var l transport.Listener
+	var err error
+	if _, last := ma.SplitLast(a); last != nil && last.Protocol().Code == P_SSH {
+		l, err = t.tcpListen(a)
+	} else {
+		l, err = t.maListen(a)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return malist, nil
+	if err := t.addListener(l.(*listener)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
-
@@ -1,13 +1,16 @@
 package wstransport
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"context"
+	"crypto/tls"
 	"net/http"
 
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -111,11 +114,17 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 // close error, subsequent and concurrent calls will return nil.
 // This method is thread-safe.
 func (c *Conn) Close() error {
+	return c.CloseWithReason(ws.CloseNormalClosure, "closed")
+}
+
+// CloseWithReason closes the connection, sending the code and reason to the
+// remote side in the close frame.
+func (c *Conn) CloseWithReason(code int, reason string) error {
 	var err error
 	c.closeOnce.Do(func() {
 		err1 := c.Conn.WriteControl(
 			ws.CloseMessage,
-			ws.FormatCloseMessage(ws.CloseNormalClosure, "closed"),
+			ws.FormatCloseMessage(code, reason),
 			time.Now().Add(GracefulCloseTimeout),
 		)
 		err2 := c.Conn.Close()
@@ -169,24 +178,20 @@ func NewConn(raw *ws.Conn) *Conn {
 	}
 }
 
-// Default gorilla upgrader
-var upgrader = ws.Upgrader{
-	// Allow requests from *all* origins.
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-	Subprotocols: []string{PROTO_SSH},
-}
-
 const PROTO_SSH = "/ssh/1.0"
 
 func (t *SSHTransport) maDial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if err := t.interceptDial(raddr, p); err != nil {
+		return nil, err
+	}
+
 	wsurl, err := parseMultiaddr(raddr)
 	if err != nil {
 		return nil, err
 	}
 
 	wscl := &ws.Dialer{
+		TLSClientConfig:  t.clientTLSConfig(raddr),
 		Proxy:            http.ProxyFromEnvironment,
 		HandshakeTimeout: 5 * time.Second,
 		Subprotocols: []string{
@@ -194,70 +199,159 @@ func (t *SSHTransport) maDial(ctx context.Context, raddr ma.Multiaddr, p peer.ID
 		},
 	}
 
-	wscon, _, err := wscl.Dial(wsurl, nil)
+	wscon, resp, err := wscl.Dial(wsurl, nil)
 	if err != nil {
+		if resp != nil {
+			// Includes rejections from the remote gater.
+			return nil, fmt.Errorf("dial %s: %s: %w", wsurl, resp.Status, err)
+		}
 		return nil, err
 	}
 
-	mnc, err := manet.WrapNetConn(NewConn(wscon))
+	// Not wrapped, closeGated needs the close frame.
+	nc := NewConn(wscon)
+
+	if PROTO_SSH != wscon.Subprotocol() {
+		// Stock libp2p ws listener.
+		return t.upgradeLibp2p(nc, raddr, p)
+	}
+
+	c, err := t.newCapableConn(nc, false, raddr, p)
 	if err != nil {
-		wscon.Close()
 		return nil, err
 	}
+	return c, nil
+}
 
-	if PROTO_SSH == wscon.Subprotocol() {
-
+// clientTLSConfig returns the TLS config for dialing raddr.
+func (t *SSHTransport) clientTLSConfig(raddr ma.Multiaddr) *tls.Config {
+	var cfg *tls.Config
+	if t.ClientTLSConfig != nil {
+		cfg = t.ClientTLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
 	}
-
-	return t.NewCapableConn(mnc, false)
+	if cfg.ServerName == "" {
+		if _, host, err := manet.DialArgs(raddr); err == nil {
+			cfg.ServerName = dialHost(host)
+		}
+	}
+	return cfg
 }
 
 func (t *SSHTransport) maListen(a ma.Multiaddr) (transport.Listener, error) {
+	if t.Mux != nil {
+		return t.mount(a)
+	}
+
 	lnet, lnaddr, err := manet.DialArgs(a)
 	if err != nil {
 		return nil, err
 	}
 
+	if isSecureWs(a) && t.TLSConfig == nil {
+		return nil, fmt.Errorf("listen %s: TLSConfig not set", a)
+	}
+
 	nl, err := net.Listen(lnet, lnaddr)
 	if err != nil {
 		return nil, err
 	}
 
-	u, err := url.Parse("http://" + nl.Addr().String())
+	laddr, err := manet.FromNetAddr(nl.Addr())
 	if err != nil {
 		nl.Close()
 		return nil, err
 	}
+	laddr = laddr.Encapsulate(wsSuffix(a))
 
-	malist, err := t.wrapListener(nl, u)
-	if err != nil {
-		nl.Close()
-		return nil, err
+	malist := t.wrapListener(nl, laddr)
+	malist.addr = nl.Addr()
+	if isSecureWs(a) {
+		malist.l = tls.NewListener(nl, t.TLSConfig)
 	}
-	if t.Mux != nil {
-		t.Mux.Handle(t.Prefix, malist)
-	} else {
-		go malist.serve()
+	go malist.serve()
+	return malist, nil
+}
+
+// mount registers a listener on the Mux, at the /http-path of the address,
+// or Prefix. The server owning the Mux listens - the address is the one it
+// is reachable at, and is advertised as is.
+func (t *SSHTransport) mount(a ma.Multiaddr) (transport.Listener, error) {
+	path := httpPath(a)
+	if path == "/" && t.Prefix != "" {
+		path = "/" + strings.TrimPrefix(t.Prefix, "/")
+		a = a.Encapsulate(ma.StringCast("/http-path/" + url.PathEscape(path[1:])))
+	}
+	t.mountsMu.Lock()
+	defer t.mountsMu.Unlock()
+	active, registered := t.mounts[path]
+	if active != nil {
+		return nil, fmt.Errorf("listen %s: path %s already mounted", a, path)
+	}
+	malist := t.wrapListener(nil, a)
+	malist.mountPath = path
+	if t.mounts == nil {
+		t.mounts = map[string]*listener{}
+	}
+	t.mounts[path] = malist
+	if !registered {
+		// Handlers can't be removed from a ServeMux, the path is registered
+		// once and dispatches to the current listener.
+		t.Mux.Handle(path, &mountHandler{t: t, path: path})
 	}
 	return malist, nil
 }
 
-func (t *SSHTransport) wrapListener(l net.Listener, origin *url.URL) (*listener, error) {
-	laddr, err := manet.FromNetAddr(l.Addr())
-	if err != nil {
-		return nil, err
+// unmount detaches a closed listener from its path.
+func (t *SSHTransport) unmount(l *listener) {
+	t.mountsMu.Lock()
+	defer t.mountsMu.Unlock()
+	if t.mounts[l.mountPath] == l {
+		t.mounts[l.mountPath] = nil
 	}
-	wsma, err := ma.NewMultiaddr("/ws")
-	if err != nil {
-		return nil, err
+}
+
+// mountHandler is registered on the Mux for a path, and serves requests with
+// the listener mounted there, if any.
+type mountHandler struct {
+	t    *SSHTransport
+	path string
+}
+
+func (h *mountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.t.mountsMu.Lock()
+	l := h.t.mounts[h.path]
+	h.t.mountsMu.Unlock()
+	if l == nil {
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
 	}
-	laddr = laddr.Encapsulate(wsma)
+	l.ServeHTTP(w, r)
+}
 
-	return &listener{
+func (t *SSHTransport) wrapListener(l net.Listener, laddr ma.Multiaddr) *listener {
+	var limiter *rateLimiter
+	if t.ConnRateLimit > 0 {
+		limiter = newRateLimiter(t.ConnRateLimit, t.ConnRateBurst)
+	}
+
+	ml := &listener{
+		pending:  make(chan struct{}, t.maxPendingHandshakes()),
+		limiter:  limiter,
+		upgrader: ws.Upgrader{
+			CheckOrigin:  t.checkOrigin,
+			Subprotocols: []string{PROTO_SSH},
+		},
 		t: t,
 		laddr:    laddr,
 		l: l,
-		incoming: make(chan *Conn),
+		incoming: make(chan net.Conn, t.maxPendingHandshakes()),
+		ready:    make(chan transport.CapableConn, t.acceptBacklog()),
 		closed:   make(chan struct{}),
-	}, nil
+	}
+	for i := 0; i < t.handshakeWorkers(); i++ {
+		go ml.handshakeWorker()
+	}
+	return ml
 }